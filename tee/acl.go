@@ -0,0 +1,85 @@
+package tee
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// client networks set by -allow-cidr and -deny-cidr, no allowed networks lets in every client not denied
+var allowedNets, deniedNets []*net.IPNet
+
+func parseCIDRs(name string, list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, cidr := range list {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s value %q: %v", name, cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// deny networks win over allow ones, a remote address that can't be parsed is only let in without any lists set
+func clientAllowed(remoteAddr string) bool {
+	if len(allowedNets) == 0 && len(deniedNets) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range deniedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(allowedNets) == 0 {
+		return true
+	}
+	for _, n := range allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// with -basic-auth set clients have to send its credentials, they are meant for tee-proxy only and get removed
+// from the request, both parts are always compared in full so timing doesn't tell how much of them matched
+func authorized(r *http.Request) bool {
+	if *basicAuth == "" {
+		return true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	wantUser, wantPass := splitCredentials(*basicAuth)
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser))
+	passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass))
+	if userOk&passOk != 1 {
+		return false
+	}
+
+	r.Header.Del("Authorization")
+	return true
+}
+
+func splitCredentials(credentials string) (string, string) {
+	i := strings.Index(credentials, ":")
+	if i < 0 {
+		return credentials, ""
+	}
+	return credentials[:i], credentials[i+1:]
+}
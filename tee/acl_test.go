@@ -0,0 +1,103 @@
+package tee
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCIDRs(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	p := newProxy(t, &Config{
+		Production:   ptr(production.URL),
+		Alternatives: alternatives(alternative.URL),
+		AllowCIDR:    []string{"10.0.0.0/8", "2001:db8::/32"},
+		DenyCIDR:     []string{"10.1.0.0/16"},
+	})
+
+	for remoteAddr, want := range map[string]int{
+		"10.2.3.4:5000":      http.StatusOK,
+		"[2001:db8::1]:5000": http.StatusOK,
+		"10.1.2.3:5000":      http.StatusForbidden,
+		"192.168.1.1:5000":   http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/orders", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		p.Handler().ServeHTTP(rec, req)
+		mirrors.Wait()
+
+		if rec.Code != want {
+			t.Errorf("%s answered %d, want %d", remoteAddr, rec.Code, want)
+		}
+		forwarded := want == http.StatusOK
+		if got := len(fromProduction) == 1; got != forwarded {
+			t.Errorf("%s proxied %v, want %v", remoteAddr, got, forwarded)
+		}
+		if got := len(fromAlternative) == 1; got != forwarded {
+			t.Errorf("%s mirrored %v, want %v", remoteAddr, got, forwarded)
+		}
+		for len(fromProduction) > 0 {
+			<-fromProduction
+		}
+		for len(fromAlternative) > 0 {
+			<-fromAlternative
+		}
+	}
+}
+
+func TestInvalidCIDR(t *testing.T) {
+	if err := proxyError(t, &Config{DenyCIDR: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("invalid -deny-cidr accepted")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), BasicAuth: ptr("tee:s3cret")})
+
+	for _, tc := range []struct {
+		name       string
+		user, pass string
+		want       int
+	}{
+		{"correct", "tee", "s3cret", http.StatusOK},
+		{"wrong password", "tee", "guess", http.StatusUnauthorized},
+		{"wrong user", "root", "s3cret", http.StatusUnauthorized},
+		{"missing", "", "", http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s credentials answered %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized {
+			if resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("%s credentials answered without WWW-Authenticate", tc.name)
+			}
+			if len(fromProduction) != 0 || len(fromAlternative) != 0 {
+				t.Errorf("%s credentials reached a backend", tc.name)
+			}
+			continue
+		}
+		// the credentials are for the proxy only
+		for name, received := range map[string]chan *http.Request{"production": fromProduction, "alternative": fromAlternative} {
+			if r := receive(t, received); r.Header.Get("Authorization") != "" {
+				t.Errorf("%s got the proxy credentials", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package tee
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// responseAssertion validates the last response an alternative returned for a mirror, an error means it failed
+type responseAssertion func(ctx context.Context, id string, response *capturedResponse) error
+
+// nil unless -assert-cmd is set
+var assertResponse responseAssertion
+
+// runs command with sh, the response body on stdin and status code in TEEPROXY_STATUS, exiting non-zero fails the assertion
+func commandAssertion(command string) responseAssertion {
+	return func(ctx context.Context, id string, response *capturedResponse) error {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Stdin = bytes.NewReader(response.Body)
+		cmd.Env = append(os.Environ(),
+			"TEEPROXY_ID="+id,
+			"TEEPROXY_STATUS="+strconv.Itoa(response.StatusCode),
+			"TEEPROXY_CONTENT_TYPE="+response.Header.Get("Content-Type"),
+		)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+}
+
+func checkAssertion(ctx context.Context, id string, response *capturedResponse) {
+	if err := assertResponse(ctx, id, response); err != nil {
+		atomic.AddInt64(&assertFailuresTotal, 1)
+		logMessage(id, "WARN", fmt.Sprintf("Assertion failed: <%v>", err))
+	}
+}
@@ -0,0 +1,34 @@
+package tee
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAssertCmdCountsFailures(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.TrimPrefix(r.URL.Path, "/"))
+	})
+	// fails for the body "broken" and for anything other than a 200
+	s := newTestProxy(t, &Config{
+		Production:   ptr(production.URL),
+		Alternatives: alternatives(alternative.URL),
+		AssertCmd:    ptr(`test "$TEEPROXY_STATUS" = 200 && ! grep -q broken && echo checked`),
+	})
+	failures := scrapeMetric(t, "teeproxy_assert_failures_total")
+
+	for _, path := range []string{"/fine", "/broken", "/also-fine"} {
+		get(t, s.URL+path)
+		mirrors.Wait()
+	}
+	if n := scrapeMetric(t, "teeproxy_assert_failures_total") - failures; n != 1 {
+		t.Errorf("%d assertion failures counted, want 1", n)
+	}
+	if got := log.String(); strings.Count(got, "[Assertion failed: <exit status 1: >]") != 1 {
+		t.Errorf("failed assertion not logged once: %s", got)
+	}
+}
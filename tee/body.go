@@ -0,0 +1,254 @@
+package tee
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// buffers holding request bodies are reused across requests to spare allocations under load
+var bodyPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// requestBody is a buffered request body shared read only by the production request and its mirrors,
+// the buffer goes back to the pool once every one of them released it. Bodies above -spill-threshold
+// are kept in a temp file instead, removed on release as well
+type requestBody struct {
+	buf    *bytes.Buffer
+	file   *os.File
+	stream *streamPipe
+	hash   string
+	total  int64
+	size   int64
+	refs   int32
+}
+
+func newRequestBody(refs int) *requestBody {
+	buf := bodyPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return &requestBody{buf: buf, refs: int32(refs)}
+}
+
+// buffers everything read from src, once more than threshold bytes arrived all of it moves to a temp file,
+// when that can't be created the body stays in memory
+func (b *requestBody) fill(src io.Reader, threshold int64) {
+	if threshold <= 0 {
+		b.total, _ = io.Copy(b.buf, src)
+		b.size = b.total
+		return
+	}
+
+	n, _ := io.Copy(b.buf, io.LimitReader(src, threshold+1))
+	if n > threshold {
+		if f, err := ioutil.TempFile("", "teeproxy-body-"); err != nil {
+			logMessage("", "WARN", fmt.Sprintf("Could not spill request body to disk, keeping it in memory: <%v>", err))
+		} else {
+			b.buf.WriteTo(f)
+			rest, _ := io.Copy(f, src)
+			b.file, n = f, n+rest
+		}
+	}
+	if b.file == nil {
+		rest, _ := io.Copy(b.buf, src)
+		n += rest
+	}
+	b.total, b.size = n, n
+}
+
+// streamed bodies aren't buffered whole, production passes what it reads on to the only mirror's Reader
+// through a buffer of limit bytes, see streamable for when that's done
+func newStreamedBody(request *http.Request, limit int) *requestBody {
+	pipe := newStreamPipe(limit)
+	request.Body = &streamedBody{ReadCloser: request.Body, pipe: pipe}
+	return &requestBody{stream: pipe, size: request.ContentLength}
+}
+
+// body sent to mirrors, may be shorter than what production gets when -max-body applies
+func (b *requestBody) Reader() io.Reader {
+	if b.stream != nil {
+		return b.stream
+	}
+	return b.section(b.size)
+}
+
+func (b *requestBody) Len() int64 {
+	return b.size
+}
+
+// temp file is read with ReadAt, so concurrent readers don't share an offset
+func (b *requestBody) section(n int64) io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, n)
+	}
+	if b.buf == nil {
+		return bytes.NewReader(nil)
+	}
+	return bytes.NewReader(b.buf.Bytes()[:n])
+}
+
+func (b *requestBody) release() {
+	// a mirror done with a streamed body, or not sending it at all, no longer holds production up
+	if b.stream != nil {
+		b.stream.Close()
+		return
+	}
+	if b.buf == nil {
+		return
+	}
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		buf, file := b.buf, b.file
+		b.buf, b.file = nil, nil
+		bodyPool.Put(buf)
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
+}
+
+// productionBody reads the buffered part of a body followed by the rest left unread, releasing the buffer when closed
+type productionBody struct {
+	io.Reader
+	body *requestBody
+	once sync.Once
+}
+
+func (p *productionBody) Close() error {
+	p.once.Do(p.body.release)
+	return nil
+}
+
+// hashedBody is a production body whose hash is logged when closed, provided production read all of it
+type hashedBody struct {
+	io.ReadCloser
+	id   string
+	hash hash.Hash
+	read int64
+	eof  bool
+	once sync.Once
+}
+
+func (h *hashedBody) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.hash.Write(p[:n])
+	h.read += int64(n)
+	if err == io.EOF {
+		h.eof = true
+	}
+	return n, err
+}
+
+func (h *hashedBody) Close() error {
+	h.once.Do(func() {
+		if h.eof {
+			logMessage(h.id, "INFO", fmt.Sprintf("Request body: sha256 <%s> length <%d>", hashPrefix(h.hash), h.read))
+		}
+	})
+	return h.ReadCloser.Close()
+}
+
+// streamedBody is the production body while it's streamed to a mirror, everything read is passed on to the pipe,
+// which never holds production up
+type streamedBody struct {
+	io.ReadCloser
+	pipe *streamPipe
+}
+
+func (s *streamedBody) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if n > 0 {
+		s.pipe.write(p[:n])
+	}
+	if err != nil {
+		s.pipe.finish(err)
+	}
+	return n, err
+}
+
+// the mirror sees a body production didn't read to the end as cut short, after EOF this changes nothing
+func (s *streamedBody) Close() error {
+	s.pipe.finish(io.ErrUnexpectedEOF)
+	return s.ReadCloser.Close()
+}
+
+// streamPipe holds what production read and the mirror didn't yet in a ring of limit bytes. A mirror falling
+// further behind is cut off, dropping what's held, so production never waits for it
+type streamPipe struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	ring   []byte
+	start  int
+	held   int
+	err    error
+	closed bool
+}
+
+func newStreamPipe(limit int) *streamPipe {
+	p := &streamPipe{ring: make([]byte, limit)}
+	p.ready = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *streamPipe) write(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.err != nil {
+		return
+	}
+	if p.held+len(b) > len(p.ring) {
+		p.err = fmt.Errorf("mirror fell more than %d bytes behind production, cut off", len(p.ring))
+		p.held = 0
+	} else {
+		end := (p.start + p.held) % len(p.ring)
+		n := copy(p.ring[end:], b)
+		copy(p.ring, b[n:])
+		p.held += len(b)
+	}
+	p.ready.Broadcast()
+}
+
+// end of the body, io.EOF once production read it all
+func (p *streamPipe) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.ready.Broadcast()
+}
+
+func (p *streamPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.held == 0 && p.err == nil {
+		p.ready.Wait()
+	}
+	if p.held == 0 {
+		return 0, p.err
+	}
+	if len(b) > p.held {
+		b = b[:p.held]
+	}
+	n := copy(b, p.ring[p.start:])
+	n += copy(b[n:], p.ring[:p.start])
+	p.start = (p.start + n) % len(p.ring)
+	p.held -= n
+	return n, nil
+}
+
+// the mirror is done reading, whatever production reads after is dropped
+func (p *streamPipe) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed, p.held = true, 0
+	return nil
+}
@@ -0,0 +1,378 @@
+package tee
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPooledBodiesArentShared(t *testing.T) {
+	// a body still referenced keeps its buffer while others are taken from and put back to the pool
+	held := newRequestBody(2)
+	held.fill(strings.NewReader("held body"), 0)
+	held.release()
+	for i := 0; i < 100; i++ {
+		b := newRequestBody(1)
+		b.fill(strings.NewReader("other body"), 0)
+		b.release()
+	}
+	if got, _ := io.ReadAll(held.Reader()); string(got) != "held body" {
+		t.Errorf("held body changed to %q", got)
+	}
+	held.release()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				want := fmt.Sprintf("body %d of goroutine %d", i, g) + strings.Repeat("x", i*10)
+				b := newRequestBody(1)
+				b.fill(strings.NewReader(want), 0)
+				if got, _ := io.ReadAll(b.Reader()); string(got) != want || b.Len() != int64(len(want)) {
+					t.Errorf("pooled body read %q, want %q", got, want)
+					return
+				}
+				b.release()
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func BenchmarkRequestBody(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 32<<10)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r := newRequestBody(1)
+			r.fill(bytes.NewReader(body), 0)
+			r.release()
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(bytes.NewReader(body))
+		}
+	})
+}
+
+func TestSpilledBodyDeliveredAndRemoved(t *testing.T) {
+	// temp files end up in a directory of their own, so none are left behind unnoticed
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	captureLog(t)
+	const size = 1 << 20
+	want, _ := sha256Of(&patternReader{n: size})
+	production := make(chan string, 1)
+	productionBackend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		sum, _ := sha256Of(r.Body)
+		production <- sum
+	})
+	var attempts int32
+	mirrored := make(chan string, 2)
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		sum, _ := sha256Of(r.Body)
+		mirrored <- sum
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	s := newTestProxy(t, &Config{
+		Production:     ptr(productionBackend.URL),
+		Alternatives:   alternatives(alternative.URL),
+		SpillThreshold: ptr(int64(1024)),
+		RetryCount:     ptr(2),
+		RetryTimeoutMs: ptr(1),
+	})
+
+	// PUT is retried, unlike POST
+	req, _ := http.NewRequest("PUT", s.URL, &patternReader{n: size})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mirrors.Wait()
+
+	if got := <-production; got != want {
+		t.Error("production got another body")
+	}
+	// the retry reads the temp file again from its start
+	if len(mirrored) != 2 {
+		t.Fatalf("alternative got %d attempts, want 2", len(mirrored))
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-mirrored; got != want {
+			t.Errorf("attempt %d got another body", i+1)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmp, "teeproxy-body-*")); len(files) != 0 {
+		t.Errorf("temp files left: %v", files)
+	}
+}
+
+func TestFillSpillsAboveThreshold(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	b := newRequestBody(1)
+	b.fill(strings.NewReader(strings.Repeat("z", 100)), 10)
+	if b.file == nil || b.Len() != 100 {
+		t.Fatalf("100 byte body over a 10 byte threshold kept in memory, %d bytes", b.Len())
+	}
+	name := b.file.Name()
+	if got, _ := io.ReadAll(b.Reader()); string(got) != strings.Repeat("z", 100) {
+		t.Errorf("spilled body read %q", got)
+	}
+	b.release()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("temp file %s not removed on release: %v", name, err)
+	}
+
+	small := newRequestBody(1)
+	small.fill(strings.NewReader("tiny"), 10)
+	if small.file != nil {
+		t.Error("body under the threshold spilled")
+	}
+	small.release()
+}
+
+// reads at most chunk bytes of Reader at a time, waiting interval before each read
+type pacedReader struct {
+	io.Reader
+	chunk    int
+	interval time.Duration
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	time.Sleep(r.interval)
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	return r.Reader.Read(p)
+}
+
+func TestStreamedBodyDeliveredInBoundedMemory(t *testing.T) {
+	captureLog(t)
+	const size = 32 << 20
+	want, _ := sha256Of(&patternReader{n: size})
+	received := make(chan string, 2)
+	checksum := func(r *http.Request) {
+		sum, n := sha256Of(r.Body)
+		received <- fmt.Sprintf("%s %d", sum, n)
+	}
+	// production only starts reading once the mirror is there to keep up, here it could be cut off before it connected
+	mirrorStarted := make(chan struct{})
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-mirrorStarted
+		checksum(r)
+	})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		close(mirrorStarted)
+		checksum(r)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), RetryCount: ptr(1), StreamBuffer: ptr(2 << 20)})
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	// uploaded at about 128MB/s at most, as fast as both destinations take it even with the race detector
+	req, _ := http.NewRequest("PUT", s.URL, &pacedReader{Reader: &patternReader{n: size}, chunk: 128 << 10, interval: time.Millisecond})
+	req.ContentLength = size
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mirrors.Wait()
+	runtime.ReadMemStats(&after)
+
+	for i := 0; i < 2; i++ {
+		if got := <-received; got != fmt.Sprintf("%s %d", want, size) {
+			t.Errorf("got body %s, want %s %d", got, want, size)
+		}
+	}
+	// buffering the body whole would allocate it at least once
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("allocated %d bytes streaming a body of %d", allocated, size)
+	}
+}
+
+func TestSlowMirrorDoesntHoldUpStreamedProduction(t *testing.T) {
+	logs := captureLog(t)
+	const size = 8 << 20
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+	release := make(chan struct{})
+	mirrored := make(chan error, 1)
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, err := io.Copy(io.Discard, r.Body)
+		mirrored <- err
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), RetryCount: ptr(1), StreamBuffer: ptr(64 << 10)})
+
+	start := time.Now()
+	req, _ := http.NewRequest("PUT", s.URL, &patternReader{n: size})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || time.Since(start) > 2*time.Second {
+		t.Errorf("production answered %d after %v", resp.StatusCode, time.Since(start))
+	}
+
+	// the mirror fell behind by more than the buffer and was cut off
+	close(release)
+	select {
+	case err := <-mirrored:
+		if err == nil {
+			t.Error("mirror got the whole body although it fell behind")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror never finished")
+	}
+	mirrors.Wait()
+	if !strings.Contains(logs.String(), "mirror fell more than 65536 bytes behind production") {
+		t.Errorf("cut off mirror not logged:\n%s", logs)
+	}
+}
+
+func TestStreamingFallsBackToBuffering(t *testing.T) {
+	captureLog(t)
+	const size = 1 << 20
+	want, _ := sha256Of(&patternReader{n: size})
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var attempts int32
+	mirrored := make(chan string, 4)
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		sum, _ := sha256Of(r.Body)
+		mirrored <- sum
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	for name, config := range map[string]*Config{
+		// a retry needs the body again, -mirror-only doesn't let production read it
+		"retries":     {RetryCount: ptr(2), RetryTimeoutMs: ptr(1)},
+		"mirror-only": {RetryCount: ptr(1), MirrorOnly: ptr(true)},
+	} {
+		atomic.StoreInt32(&attempts, 0)
+		config.Production, config.Alternatives, config.StreamBuffer = ptr(production.URL), alternatives(alternative.URL), ptr(1024)
+		s := newTestProxy(t, config)
+		req, _ := http.NewRequest("PUT", s.URL, &patternReader{n: size})
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+		for len(mirrored) > 0 {
+			if got := <-mirrored; got != want {
+				t.Errorf("%s: mirror got another body", name)
+			}
+		}
+		if n := atomic.LoadInt32(&attempts); n == 0 || (name == "retries" && n != 2) {
+			t.Errorf("%s: alternative got %d attempts", name, n)
+		}
+	}
+}
+
+func TestMaxMirrorBody(t *testing.T) {
+	logs := captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MaxMirrorBody: ptr(int64(100))})
+	skipped, failed := scrapeMetric(t, "teeproxy_mirror_oversized_total"), scrapeMetric(t, "teeproxy_mirror_errors_total")
+
+	send := func(body io.Reader) {
+		req, _ := http.NewRequest("POST", s.URL, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+	}
+	small := strings.Repeat("s", 100)
+	send(strings.NewReader(small))
+	receive(t, fromProduction)
+	if body := bodyOf(receive(t, fromAlternative)); body != small {
+		t.Errorf("alternative got %d bytes of a small body", len(body))
+	}
+
+	// too large whether the length is known up front or only once the body is read
+	large := strings.Repeat("l", 101)
+	for _, body := range []io.Reader{strings.NewReader(large), io.MultiReader(strings.NewReader(large))} {
+		send(body)
+		if r := receive(t, fromProduction); bodyOf(r) != large {
+			t.Errorf("production didn't get all of a large body of length %d", r.ContentLength)
+		}
+		if len(fromAlternative) != 0 {
+			t.Error("large body mirrored")
+			receive(t, fromAlternative)
+		}
+	}
+	if n := scrapeMetric(t, "teeproxy_mirror_oversized_total") - skipped; n != 2 {
+		t.Errorf("%d skips counted, want 2", n)
+	}
+	if n := scrapeMetric(t, "teeproxy_mirror_errors_total") - failed; n != 0 {
+		t.Errorf("%d skips counted as errors", n)
+	}
+	if !strings.Contains(logs.String(), "[Request body of 101 bytes exceeds 100 bytes, not mirroring]") || !strings.Contains(logs.String(), "[Request body exceeds 100 bytes, not mirroring]") {
+		t.Errorf("skips not logged:\n%s", logs)
+	}
+}
+
+func TestMaxMirrorBodyAboveMaxBody(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MaxMirrorBody: ptr(int64(1000)), MaxBody: ptr(int64(100))})
+	skipped := scrapeMetric(t, "teeproxy_mirror_oversized_total")
+
+	send := func(body string) {
+		// of unknown length, so only reading it tells how large it is
+		req, _ := http.NewRequest("POST", s.URL, io.MultiReader(strings.NewReader(body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+	}
+	// over -max-body only, mirrored truncated
+	medium := strings.Repeat("m", 500)
+	send(medium)
+	receive(t, fromProduction)
+	if body := bodyOf(receive(t, fromAlternative)); body != medium[:100] {
+		t.Errorf("alternative got %d bytes, want 100", len(body))
+	}
+
+	// over -max-mirror-body as well, not mirrored at all
+	large := strings.Repeat("l", 5000)
+	send(large)
+	if body := bodyOf(receive(t, fromProduction)); body != large {
+		t.Errorf("production got %d bytes, want all of them", len(body))
+	}
+	if len(fromAlternative) != 0 {
+		t.Errorf("alternative got %d bytes of a body over -max-mirror-body", len(bodyOf(receive(t, fromAlternative))))
+	}
+	if n := scrapeMetric(t, "teeproxy_mirror_oversized_total") - skipped; n != 1 {
+		t.Errorf("%d skips counted, want 1", n)
+	}
+}
@@ -0,0 +1,98 @@
+package tee
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops mirroring to an alternative destination after threshold consecutive failures,
+// once cooldown passed a single probe request is let through and its outcome closes or reopens the breaker
+// a nil breaker always allows requests
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// reports whether a request may be sent, probe is true for the request deciding whether the breaker closes again
+func (b *circuitBreaker) Allow(now time.Time) (allowed, probe bool) {
+	if b == nil {
+		return true, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		return true, true
+	case breakerHalfOpen:
+		// probe still in flight
+		return false, false
+	}
+	return true, false
+}
+
+// returns true when the breaker closed again
+func (b *circuitBreaker) Success() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	closed := b.state != breakerClosed
+	b.state = breakerClosed
+	b.failures = 0
+	return closed
+}
+
+// returns true when the breaker opened
+func (b *circuitBreaker) Failure(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = now
+		return true
+	}
+	return false
+}
+
+// request was given up without being sent, a dropped probe must not leave the breaker half open for good
+func (b *circuitBreaker) Abort() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
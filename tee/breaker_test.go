@@ -0,0 +1,95 @@
+package tee
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(3, time.Second)
+	now := time.Now()
+	allowed := func(at time.Time) bool {
+		ok, _ := b.Allow(at)
+		return ok
+	}
+
+	for i := 0; i < 2; i++ {
+		if b.Failure(now) {
+			t.Fatalf("opened after %d failures", i+1)
+		}
+	}
+	if !b.Failure(now) || allowed(now.Add(999*time.Millisecond)) {
+		t.Fatal("didn't open after 3 failures")
+	}
+
+	// a single probe once cooldown passed, failing it reopens the breaker
+	if ok, probe := b.Allow(now.Add(time.Second)); !ok || !probe {
+		t.Fatal("no probe after cooldown")
+	}
+	if allowed(now.Add(time.Second)) {
+		t.Fatal("second request let through while probing")
+	}
+	if !b.Failure(now.Add(time.Second)) || allowed(now.Add(1500*time.Millisecond)) {
+		t.Fatal("failed probe didn't reopen the breaker")
+	}
+
+	if ok, probe := b.Allow(now.Add(2 * time.Second)); !ok || !probe {
+		t.Fatal("no probe after second cooldown")
+	}
+	if !b.Success() || !allowed(now.Add(2*time.Second)) || !allowed(now.Add(2*time.Second)) {
+		t.Fatal("successful probe didn't close the breaker")
+	}
+
+	var none *circuitBreaker
+	if ok, _ := none.Allow(now); !ok {
+		t.Error("nil breaker refused a request")
+	}
+}
+
+func TestCircuitBreakerSkipsMirrors(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var failing int32 = 1
+	var attempts int32
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	s := newTestProxy(t, &Config{
+		Production:   ptr(production.URL),
+		Alternatives: alternatives(alternative.URL),
+		RetryCount:   ptr(1),
+		CBThreshold:  ptr(2),
+		CBCooldown:   ptr(200),
+	})
+	skipped := scrapeMetric(t, "teeproxy_mirror_circuit_open_total")
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			get(t, s.URL)
+			mirrors.Wait()
+		}
+	}
+
+	send(5)
+	if attempts != 2 {
+		t.Errorf("alternative got %d mirrors, want 2 before the breaker opened", attempts)
+	}
+	if n := scrapeMetric(t, "teeproxy_mirror_circuit_open_total") - skipped; n != 3 {
+		t.Errorf("%d mirrors counted as skipped, want 3", n)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(250 * time.Millisecond)
+	send(3)
+	if attempts != 5 {
+		t.Errorf("alternative got %d mirrors, want all 3 after recovery too", attempts)
+	}
+	if !strings.Contains(log.String(), "Circuit breaker closed for") {
+		t.Errorf("recovery not logged: %s", log)
+	}
+}
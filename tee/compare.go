@@ -0,0 +1,319 @@
+package tee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// lines of unchanged context shown around each change in a diff
+	diffContext = 3
+	// above this many line pairs the changed middle part is not aligned any further, just shown as removed and added
+	maxDiffCells = 1000000
+)
+
+// response parts kept for comparing production and alternative, Body holds at most -compare-max-body bytes,
+// request is only kept for -har-out. Duration runs until the body was read by the client or the mirror
+type capturedResponse struct {
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+	Request     *http.Request
+	RequestBody []byte
+	Started     time.Time
+	Duration    time.Duration
+}
+
+// comparison pairs the production response of one request with responses of its mirrors,
+// handler sets production once proxying finished and every mirror waits for it before comparing.
+// With -golden-file the baseline is the golden response instead, set right away
+type comparison struct {
+	done       chan struct{}
+	production *capturedResponse
+	baseline   string
+}
+
+type comparisonKey struct{}
+
+func newComparison() *comparison {
+	return &comparison{done: make(chan struct{}), baseline: "production"}
+}
+
+func (c *comparison) setProduction(production *capturedResponse) {
+	c.production = production
+	close(c.done)
+}
+
+func (c *comparison) compare(id string, alternative *capturedResponse) {
+	<-c.done
+	compareResponses(id, c.baseline, c.production, alternative)
+	// a golden response has no request of its own to archive
+	if c.baseline == "production" {
+		har.add(id, c.production, alternative)
+	}
+}
+
+// logs the differences between the baseline, production or golden, and alternative response, or that they match
+func compareResponses(id, baseline string, production, alternative *capturedResponse) {
+	match := true
+
+	if production.StatusCode != alternative.StatusCode {
+		match = false
+		logMessage(id, "WARN", fmt.Sprintf("Status code mismatch: %s <%d> alternative <%d>", baseline, production.StatusCode, alternative.StatusCode))
+	}
+
+	productionBody, alternativeBody := decodedBody(production), decodedBody(alternative)
+	if !bytes.Equal(productionBody, alternativeBody) {
+		match = false
+		logMessage(id, "WARN", fmt.Sprintf("Body mismatch: <%s>", unifiedDiff(baseline, "alternative", productionBody, alternativeBody)))
+	}
+
+	if *compareHeaders {
+		alternativeHeader := alternative.Header
+		// golden responses list the headers that matter, others the alternative sends aren't reported
+		if baseline == "golden" {
+			alternativeHeader = make(http.Header)
+			for name := range production.Header {
+				if values, ok := alternative.Header[name]; ok {
+					alternativeHeader[name] = values
+				}
+			}
+		}
+		if diff := headerDiff(production.Header, alternativeHeader); len(diff) > 0 {
+			match = false
+			logMessage(id, "WARN", fmt.Sprintf("Header mismatch: <%s>", strings.Join(diff, "\n")))
+		}
+	}
+
+	if match {
+		logMessage(id, "INFO", "Responses match")
+	}
+
+	// timing is reported on its own, a slow alternative can still respond correctly
+	if *latencyFactor > 0 && production.Duration > 0 && float64(alternative.Duration) > *latencyFactor*float64(production.Duration) {
+		atomic.AddInt64(&slowMirrorsTotal, 1)
+		logMessage(id, "WARN", fmt.Sprintf("Latency regression: production <%v> alternative <%v>, %.1f times slower", production.Duration, alternative.Duration, float64(alternative.Duration)/float64(production.Duration)))
+	}
+}
+
+// one line per header the alternative added (+), removed (-) or answered with other values (~), ignoredHeaders left out
+func headerDiff(production, alternative http.Header) []string {
+	names := map[string]bool{}
+	for name := range production {
+		names[name] = true
+	}
+	for name := range alternative {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !ignoredHeaders[http.CanonicalHeaderKey(name)] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	var diff []string
+	for _, name := range sorted {
+		p, pok := production[name]
+		a, aok := alternative[name]
+		pv, av := strings.Join(p, ", "), strings.Join(a, ", ")
+		switch {
+		case !aok:
+			diff = append(diff, fmt.Sprintf("-%s: %s", name, pv))
+		case !pok:
+			diff = append(diff, fmt.Sprintf("+%s: %s", name, av))
+		case pv != av:
+			diff = append(diff, fmt.Sprintf("~%s: %s -> %s", name, pv, av))
+		}
+	}
+	return diff
+}
+
+// gzipped bodies are compared decompressed, as equal content may compress differently,
+// a body that doesn't decompress cleanly is compared as it is
+func decodedBody(response *capturedResponse) []byte {
+	if !strings.EqualFold(response.Header.Get("Content-Encoding"), "gzip") {
+		return response.Body
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(response.Body))
+	if err != nil {
+		return response.Body
+	}
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return response.Body
+	}
+	return decoded
+}
+
+// keeps the first limit bytes written to it and silently drops the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// io.Copy would use ReadFrom of the embedded Buffer otherwise, which doesn't keep to the limit
+func (b *cappedBuffer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{b}, r)
+}
+
+type diffLine struct {
+	op   byte // ' ' for unchanged, '-' for removed and '+' for added lines
+	text string
+}
+
+// line based diff of a and b in unified format, with hunks of changes surrounded by diffContext lines
+func unifiedDiff(aName, bName string, a, b []byte) string {
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	// aLines[i] and bLines[i] count lines of a and b before lines[i], for numbering hunks
+	aLines, bLines := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	var changes []int
+	for i, l := range lines {
+		aLines[i+1], bLines[i+1] = aLines[i], bLines[i]
+		if l.op != '+' {
+			aLines[i+1]++
+		}
+		if l.op != '-' {
+			bLines[i+1]++
+		}
+		if l.op != ' ' {
+			changes = append(changes, i)
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+
+	for c := 0; c < len(changes); {
+		// changes closer than twice the context end up in the same hunk
+		last := c
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext {
+			last++
+		}
+
+		start := changes[c] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changes[last] + diffContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aLines[start]+1, aLines[end]-aLines[start], bLines[start]+1, bLines[end]-bLines[start])
+		for _, l := range lines[start:end] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			out.WriteByte('\n')
+		}
+
+		c = last + 1
+	}
+
+	return out.String()
+}
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+// edit script turning a into b, common prefix and suffix are matched directly and the rest aligned by longest common subsequence
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []diffLine
+	for _, l := range a[:prefix] {
+		lines = append(lines, diffLine{' ', l})
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(midA)*len(midB) > maxDiffCells {
+		for _, l := range midA {
+			lines = append(lines, diffLine{'-', l})
+		}
+		for _, l := range midB {
+			lines = append(lines, diffLine{'+', l})
+		}
+	} else {
+		lines = append(lines, lcsDiff(midA, midB)...)
+	}
+
+	for _, l := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', l})
+	}
+	return lines
+}
+
+func lcsDiff(a, b []string) []diffLine {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+	return lines
+}
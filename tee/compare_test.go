@@ -0,0 +1,212 @@
+package tee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	got := unifiedDiff("production", "alternative", []byte("a\nb\nc\n"), []byte("a\nB\nc\n"))
+	want := "--- production\n+++ alternative\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"
+	if got != want {
+		t.Errorf("diff\n%s\nwant\n%s", got, want)
+	}
+	if got := unifiedDiff("production", "alternative", []byte("same\n"), []byte("same\n")); got != "--- production\n+++ alternative\n" {
+		t.Errorf("diff of equal bodies has hunks: %q", got)
+	}
+}
+
+// proxy comparing production and alternative, each answering with status and body, returns the log of one request
+func compareLog(t *testing.T, config *Config, productionStatus int, productionBody string, alternativeStatus int, alternativeBody string) string {
+	t.Helper()
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(productionStatus)
+		fmt.Fprint(w, productionBody)
+	})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(alternativeStatus)
+		fmt.Fprint(w, alternativeBody)
+	})
+	config.Production, config.Alternatives, config.Compare = ptr(production.URL), alternatives(alternative.URL), ptr(true)
+	s := newTestProxy(t, config)
+
+	if _, body := get(t, s.URL); body != productionBody {
+		t.Errorf("client got %q, want the production body", body)
+	}
+	mirrors.Wait()
+	return log.String()
+}
+
+func TestCompareMatchingResponses(t *testing.T) {
+	log := compareLog(t, &Config{}, 200, "same\n", 200, "same\n")
+	if !strings.Contains(log, "[Responses match]") || strings.Contains(log, "mismatch") {
+		t.Errorf("unexpected comparison: %s", log)
+	}
+}
+
+func TestCompareMismatchingResponses(t *testing.T) {
+	log := compareLog(t, &Config{}, 200, "a\nb\nc\n", 500, "a\nB\nc\n")
+	if !strings.Contains(log, "[Status code mismatch: production <200> alternative <500>]") {
+		t.Errorf("status mismatch not logged: %s", log)
+	}
+	if !strings.Contains(log, `[Body mismatch: <--- production\n+++ alternative\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n>]`) {
+		t.Errorf("body diff not logged: %s", log)
+	}
+	if strings.Contains(log, "Responses match") {
+		t.Errorf("mismatching responses reported as matching: %s", log)
+	}
+}
+
+func TestCompareMaxBody(t *testing.T) {
+	// bodies only differ past the compared part
+	log := compareLog(t, &Config{CompareMaxBody: ptr(4)}, 200, "samefirst", 200, "samesecond")
+	if !strings.Contains(log, "[Responses match]") {
+		t.Errorf("bodies compared past -compare-max-body: %s", log)
+	}
+}
+
+func gzipped(t *testing.T, body string, level int, modTime time.Time) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&b, level)
+	w.ModTime = modTime
+	io.WriteString(w, body)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestCompareGzippedResponses(t *testing.T) {
+	gzipHeader := func() http.Header { return http.Header{"Content-Encoding": {"gzip"}} }
+	production := gzipped(t, "same\ncontent\n", gzip.BestSpeed, time.Unix(1, 0))
+	same := gzipped(t, "same\ncontent\n", gzip.BestCompression, time.Unix(2, 0))
+	other := gzipped(t, "other\ncontent\n", gzip.BestCompression, time.Unix(2, 0))
+	if bytes.Equal(production, same) {
+		t.Fatal("compressed bodies should differ")
+	}
+
+	for _, tc := range []struct {
+		name        string
+		alternative []byte
+		want        string
+	}{
+		{"same content", same, "[Responses match]"},
+		{"other content", other, "-same\\n+other\\n"},
+		// not gzip at all despite the header, the raw bytes are compared
+		{"malformed", []byte("not gzip"), "+not gzip"},
+	} {
+		log := captureLog(t)
+		compareResponses("id", "production",
+			&capturedResponse{StatusCode: 200, Header: gzipHeader(), Body: production},
+			&capturedResponse{StatusCode: 200, Header: gzipHeader(), Body: tc.alternative})
+		if got := log.String(); !strings.Contains(got, tc.want) {
+			t.Errorf("%s logged %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCompareHeaders(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", "1")
+		w.Header().Set("X-Old", "yes")
+		w.Header().Set("X-Trace", "production")
+	})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", "2")
+		w.Header().Set("X-New", "yes")
+		w.Header().Set("X-Trace", "alternative")
+	})
+	s := newTestProxy(t, &Config{
+		Production:           ptr(production.URL),
+		Alternatives:         alternatives(alternative.URL),
+		Compare:              ptr(true),
+		CompareHeaders:       ptr(true),
+		CompareIgnoreHeaders: []string{"Date", "x-trace"},
+	})
+
+	get(t, s.URL)
+	mirrors.Wait()
+	if want := `[Header mismatch: <+X-New: yes\n-X-Old: yes\n~X-Version: 1 -> 2>]`; !strings.Contains(log.String(), want) {
+		t.Errorf("log misses %s: %s", want, log)
+	}
+}
+
+func TestLatencyRegression(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		alternativeLag time.Duration
+		regressions    int64
+	}{
+		{"slow alternative", 300 * time.Millisecond, 1},
+		{"alternative as fast", 0, 0},
+	} {
+		logs := captureLog(t)
+		production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			io.WriteString(w, "same")
+		})
+		alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20*time.Millisecond + tc.alternativeLag)
+			io.WriteString(w, "same")
+		})
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), Compare: ptr(true), LatencyRegressionFactor: ptr(3.0)})
+		before := scrapeMetric(t, "teeproxy_latency_regressions_total")
+
+		get(t, s.URL)
+		mirrors.Wait()
+		counted := scrapeMetric(t, "teeproxy_latency_regressions_total") - before
+		if warned := strings.Contains(logs.String(), "[Latency regression: production <"); warned != (tc.regressions > 0) || counted != tc.regressions {
+			t.Errorf("%s: warned %v and counted %d regressions:\n%s", tc.name, warned, counted, logs)
+		}
+		// timing doesn't make the responses differ
+		if !strings.Contains(logs.String(), "[Responses match]") {
+			t.Errorf("%s: responses don't match:\n%s", tc.name, logs)
+		}
+	}
+}
+
+func TestInvalidLatencyRegressionFactor(t *testing.T) {
+	if err := proxyError(t, &Config{LatencyRegressionFactor: ptr(0.5)}); err == nil || !strings.Contains(err.Error(), "must be at least 1") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestComparePercent(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var mirrored int64
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&mirrored, 1)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), Compare: ptr(true), ComparePct: ptr(20)})
+	before := scrapeMetric(t, "teeproxy_comparisons_total")
+
+	const requests = 500
+	for i := 0; i < requests; i++ {
+		get(t, s.URL)
+	}
+	mirrors.Wait()
+	// every request is still mirrored, only about a fifth is compared
+	if n := atomic.LoadInt64(&mirrored); n != requests {
+		t.Errorf("mirrored %d of %d requests", n, requests)
+	}
+	if compared := scrapeMetric(t, "teeproxy_comparisons_total") - before; compared < 60 || compared > 140 {
+		t.Errorf("compared %d of %d requests with -compare-pct 20", compared, requests)
+	}
+}
+
+func TestInvalidComparePercent(t *testing.T) {
+	if err := proxyError(t, &Config{ComparePct: ptr(101)}); err == nil || !strings.Contains(err.Error(), "invalid -compare-pct value 101") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
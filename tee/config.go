@@ -0,0 +1,287 @@
+package tee
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Config holds the settings for NewProxy, the same that can be read from the -config file.
+// Every option has a field, in JSON named after its flag with dashes turned into underscores
+// unless a longer name is given, comma separated and repeated flags are arrays. Fields left
+// out are nil and keep their flag defaults. Targets are the named production targets
+// -target-header selects.
+type Config struct {
+	Listen                  *string             `json:"listen" flag:"l"`
+	Production              *string             `json:"production" flag:"a"`
+	Targets                 map[string]string   `json:"production_targets"`
+	Alternatives            []AlternativeConfig `json:"alternatives"`
+	RetryCount              *int                `json:"retry_count" flag:"rc"`
+	RetryTimeoutMs          *int                `json:"retry_timeout_ms" flag:"rt"`
+	MethodRetries           map[string]int      `json:"method_retries"`
+	Percent                 *int                `json:"pct" flag:"pct"`
+	Sampling                []SamplerConfig     `json:"sampling"`
+	ConnectTimeoutMs        *int                `json:"connect_timeout_ms" flag:"ct"`
+	HeaderTimeoutMs         *int                `json:"header_timeout_ms" flag:"ht"`
+	ProdTimeout             *int                `json:"prod_timeout" flag:"prod-timeout"`
+	HeaderSampling          *bool               `json:"header_sampling" flag:"header-sampling"`
+	LogFormat               *string             `json:"logformat" flag:"logformat"`
+	LogFile                 *string             `json:"logfile" flag:"logfile"`
+	LogFileTruncate         *bool               `json:"logfile_truncate" flag:"logfile-truncate"`
+	LogLevel                *string             `json:"loglevel" flag:"loglevel"`
+	Metrics                 *string             `json:"metrics" flag:"metrics"`
+	IncludePaths            []string            `json:"include_paths" flag:"include-paths"`
+	ExcludePaths            []string            `json:"exclude_paths" flag:"exclude-paths"`
+	MirrorContentTypes      []string            `json:"mirror_content_types" flag:"mirror-content-types"`
+	ShutdownTimeout         *int                `json:"shutdown_timeout" flag:"shutdown-timeout"`
+	MaxMirrorBody           *int64              `json:"max_mirror_body" flag:"max-mirror-body"`
+	MaxBody                 *int64              `json:"max_body" flag:"max-body"`
+	SpillThreshold          *int64              `json:"spill_threshold" flag:"spill-threshold"`
+	StreamBuffer            *int                `json:"stream_buffer" flag:"stream-buffer"`
+	MaxBodyPolicy           *string             `json:"max_body_policy" flag:"max-body-policy"`
+	Compare                 *bool               `json:"compare" flag:"compare"`
+	ComparePct              *int                `json:"compare_pct" flag:"compare-pct"`
+	GoldenFile              *string             `json:"golden_file" flag:"golden-file"`
+	CompareMaxBody          *int                `json:"compare_max_body" flag:"compare-max-body"`
+	LatencyRegressionFactor *float64            `json:"latency_regression_factor" flag:"latency-regression-factor"`
+	CompareHeaders          *bool               `json:"compare_headers" flag:"compare-headers"`
+	CompareIgnoreHeaders    []string            `json:"compare_ignore_headers" flag:"compare-ignore-headers"`
+	RetryStatuses           []string            `json:"retry_statuses" flag:"retry-statuses"`
+	MaxRetryWait            *int                `json:"max_retry_wait" flag:"max-retry-wait"`
+	Backoff                 *string             `json:"backoff" flag:"backoff"`
+	BackoffMax              *int                `json:"backoff_max" flag:"backoff-max"`
+	BackoffJitter           *bool               `json:"backoff_jitter" flag:"backoff-jitter"`
+	RetryJitter             *float64            `json:"retry_jitter" flag:"retry-jitter"`
+	MirrorGzip              *bool               `json:"mirror_gzip" flag:"mirror-gzip"`
+	TransformCmd            *string             `json:"transform_cmd" flag:"transform-cmd"`
+	AssertCmd               *string             `json:"assert_cmd" flag:"assert-cmd"`
+	GRPC                    *bool               `json:"grpc" flag:"grpc"`
+	H2C                     *bool               `json:"h2c" flag:"h2c"`
+	HealthPath              *string             `json:"health_path" flag:"health-path"`
+	DedupHeader             *string             `json:"dedup_header" flag:"dedup-header"`
+	DedupTTL                *int                `json:"dedup_ttl" flag:"dedup-ttl"`
+	DedupSize               *int                `json:"dedup_size" flag:"dedup-size"`
+	StatsInterval           *int                `json:"stats_interval" flag:"stats-interval"`
+	BasePath                *string             `json:"base_path" flag:"base-path"`
+	VersionPath             *string             `json:"version_path" flag:"version-path"`
+	StatsPath               *string             `json:"stats_path" flag:"stats-path"`
+	HealthProbe             *bool               `json:"health_probe" flag:"health-probe"`
+	Cert                    *string             `json:"cert" flag:"cert"`
+	Key                     *string             `json:"key" flag:"key"`
+	TLSMin                  *string             `json:"tls_min" flag:"tls-min"`
+	ClientCA                *string             `json:"client_ca" flag:"client-ca"`
+	TLSClientHeaders        *bool               `json:"tls_client_headers" flag:"tls-client-headers"`
+	AltInsecure             *bool               `json:"alt_insecure" flag:"alt-insecure"`
+	MirrorRPS               *float64            `json:"mirror_rps" flag:"mirror-rps"`
+	MirrorBurst             *int                `json:"mirror_burst" flag:"mirror-burst"`
+	MirrorMethod            *string             `json:"mirror_method" flag:"mirror-method"`
+	AltMaxIdleConns         *int                `json:"alt_max_idle_conns" flag:"alt-max-idle-conns"`
+	AltMaxIdleConnsPerHost  *int                `json:"alt_max_idle_conns_per_host" flag:"alt-max-idle-conns-per-host"`
+	AltIdleTimeout          *int                `json:"alt_idle_timeout" flag:"alt-idle-timeout"`
+	DryRun                  *bool               `json:"dry_run" flag:"dry-run"`
+	CBThreshold             *int                `json:"cb_threshold" flag:"cb-threshold"`
+	CBCooldown              *int                `json:"cb_cooldown" flag:"cb-cooldown"`
+	MirrorStickyKey         *string             `json:"mirror_sticky_key" flag:"mirror-sticky-key"`
+	AltRewrite              *string             `json:"alt_rewrite" flag:"alt-rewrite"`
+	MirrorUA                *string             `json:"mirror_ua" flag:"mirror-ua"`
+	MirrorUASuffix          *string             `json:"mirror_ua_suffix" flag:"mirror-ua-suffix"`
+	AltHost                 *string             `json:"alt_host" flag:"alt-host"`
+	AccessLog               *bool               `json:"access_log" flag:"access-log"`
+	HashBody                *bool               `json:"hash_body" flag:"hash-body"`
+	DumpRequests            *bool               `json:"dump_requests" flag:"dump-requests"`
+	DumpResponses           *bool               `json:"dump_responses" flag:"dump-responses"`
+	MaxHeaderBytes          *int                `json:"max_header_bytes" flag:"max-header-bytes"`
+	MaxDumpBody             *int                `json:"max_dump_body" flag:"max-dump-body"`
+	Workers                 *int                `json:"workers" flag:"workers"`
+	QueueSize               *int                `json:"queue_size" flag:"queue-size"`
+	QueueWarnThreshold      *int                `json:"queue_warn_threshold" flag:"queue-warn-threshold"`
+	DropPolicy              *string             `json:"drop_policy" flag:"drop-policy"`
+	StripExpect             *bool               `json:"strip_expect" flag:"strip-expect"`
+	ForwardedHeaders        *bool               `json:"forwarded_headers" flag:"forwarded-headers"`
+	RetryOnError            *bool               `json:"retry_on_error" flag:"retry-on-error"`
+	RetryBudget             *int                `json:"retry_budget" flag:"retry-budget"`
+	MirrorTimeout           *int                `json:"mirror_timeout" flag:"mirror-timeout"`
+	OtelEndpoint            *string             `json:"otel_endpoint" flag:"otel-endpoint"`
+	AllowConnect            *bool               `json:"allow_connect" flag:"allow-connect"`
+	TargetHeader            *string             `json:"target_header" flag:"target-header"`
+	ServeAlt                *bool               `json:"serve_alt" flag:"serve-alt"`
+	MirrorOnly              *bool               `json:"mirror_only" flag:"mirror-only"`
+	MirrorOnlyStatus        *int                `json:"mirror_only_status" flag:"mirror-only-status"`
+	AllowCIDR               []string            `json:"allow_cidr" flag:"allow-cidr"`
+	DenyCIDR                []string            `json:"deny_cidr" flag:"deny-cidr"`
+	BasicAuth               *string             `json:"basic_auth" flag:"basic-auth"`
+	HAROut                  *string             `json:"har_out" flag:"har-out"`
+	HARMaxEntries           *int                `json:"har_max_entries" flag:"har-max-entries"`
+	Record                  *string             `json:"record" flag:"record"`
+	Replay                  *string             `json:"replay" flag:"replay"`
+	Preflight               *bool               `json:"preflight" flag:"preflight"`
+	PreflightAbort          []string            `json:"preflight_abort" flag:"preflight-abort"`
+	AddHeaders              []string            `json:"add_header" flag:"add-header"`
+	StripHeaders            []string            `json:"strip_header" flag:"strip-header"`
+	HostMap                 []string            `json:"host_map" flag:"host-map"`
+}
+
+// AlternativeConfig is an alternative target given in config file, either just its URL
+// or an object carrying retry settings that override -rc and -rt for that target and its weight
+type AlternativeConfig struct {
+	URL            string `json:"url"`
+	Retries        *int   `json:"retries"`
+	RetryTimeoutMs *int   `json:"retry_timeout_ms"`
+	Weight         *int   `json:"weight"`
+}
+
+func (a *AlternativeConfig) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &a.URL)
+	}
+
+	// alias drops the UnmarshalJSON method, so decoding the object doesn't recurse
+	type alternativeConfig AlternativeConfig
+	return json.Unmarshal(b, (*alternativeConfig)(a))
+}
+
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// flags given on the command line, Main sets them before NewProxy and they take precedence over any Config
+var commandLineFlags map[string]bool
+
+// resets every option not given on the command line to its default, then sets those config has values for
+func applyConfig(config *Config) error {
+	values := make(map[string][]string)
+	if config != nil {
+		values = configValues(config)
+	}
+
+	var err error
+	options.VisitAll(func(f *flag.Flag) {
+		if err != nil || commandLineFlags[f.Name] {
+			return
+		}
+		value, ok := values[f.Name]
+		if !ok {
+			value = defaultValues(f)
+		}
+		if e := setOption(f, value); e != nil {
+			err = fmt.Errorf("invalid config value for -%s: %v", f.Name, e)
+		}
+	})
+	return err
+}
+
+// a flag that can be repeated starts out without any value
+func defaultValues(f *flag.Flag) []string {
+	if _, ok := f.Value.(*listFlag); ok {
+		return nil
+	}
+	return []string{f.DefValue}
+}
+
+// sets f as if it was given once for every value on the command line
+func setOption(f *flag.Flag, values []string) error {
+	if l, ok := f.Value.(*listFlag); ok {
+		*l = nil
+	}
+	for _, value := range values {
+		if err := f.Value.Set(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// config values as they would be given on the command line, by flag name. Fields are matched to flags by their flag tag,
+// arrays are joined by commas unless the flag is repeated instead
+func configValues(config *Config) map[string][]string {
+	values := make(map[string][]string)
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, field := v.Type().Field(i).Tag.Get("flag"), v.Field(i)
+		if name == "" || field.IsNil() {
+			continue
+		}
+		if field.Kind() != reflect.Slice {
+			values[name] = []string{fmt.Sprint(field.Elem().Interface())}
+			continue
+		}
+		list := make([]string, field.Len())
+		for j := range list {
+			list[j] = field.Index(j).String()
+		}
+		if _, repeated := options.Lookup(name).Value.(*listFlag); repeated {
+			values[name] = list
+		} else {
+			values[name] = []string{strings.Join(list, ",")}
+		}
+	}
+
+	if config.Alternatives != nil {
+		urls := make([]string, len(config.Alternatives))
+		for i, a := range config.Alternatives {
+			urls[i] = a.URL
+		}
+		values["b"] = []string{strings.Join(urls, ",")}
+	}
+	if config.MethodRetries != nil {
+		entries := make([]string, 0, len(config.MethodRetries))
+		for method, n := range config.MethodRetries {
+			entries = append(entries, fmt.Sprintf("%s=%d", method, n))
+		}
+		sort.Strings(entries)
+		values["method-retries"] = []string{strings.Join(entries, ",")}
+	}
+	return values
+}
+
+// alternative destinations for -b targets, retry settings come from flags unless config file has them for the same URL
+func buildAlternatives(targets []url.URL, config *Config) []Alternative {
+	alternatives := make([]Alternative, 0, len(targets))
+	for _, target := range targets {
+		alternative := Alternative{
+			URL:            target,
+			RetryCount:     *retryCount,
+			RetryTimeoutMs: *retryTimeoutMs,
+		}
+		// requests to a socket are plain HTTP, the socket path is only used for dialing
+		if target.Scheme == "unix" {
+			alternative.URL = url.URL{Scheme: "http", Host: "localhost"}
+			alternative.SocketPath = target.Path
+		}
+
+		if config != nil {
+			for _, a := range config.Alternatives {
+				if u, err := url.Parse(a.URL); err != nil || u.String() != target.String() {
+					continue
+				}
+				if a.Retries != nil {
+					alternative.RetryCount = *a.Retries
+				}
+				if a.RetryTimeoutMs != nil {
+					alternative.RetryTimeoutMs = *a.RetryTimeoutMs
+				}
+				if a.Weight != nil {
+					alternative.Weight = *a.Weight
+				}
+			}
+		}
+
+		alternatives = append(alternatives, alternative)
+	}
+	return alternatives
+}
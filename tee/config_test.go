@@ -0,0 +1,196 @@
+package tee
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "teeproxy.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `{
+		"listen": ":9999",
+		"production": "http://localhost:9000",
+		"alternatives": ["http://localhost:9001", {"url": "http://localhost:9002", "retries": 5, "retry_timeout_ms": 1000, "weight": 20}],
+		"retry_count": 2,
+		"retry_timeout_ms": 100,
+		"pct": 50
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *config.Listen != ":9999" || *config.Production != "http://localhost:9000" || *config.RetryCount != 2 || *config.RetryTimeoutMs != 100 || *config.Percent != 50 {
+		t.Errorf("unexpected settings %+v", config)
+	}
+	if len(config.Alternatives) != 2 || config.Alternatives[0].URL != "http://localhost:9001" || config.Alternatives[0].Retries != nil {
+		t.Fatalf("unexpected alternatives %+v", config.Alternatives)
+	}
+	if a := config.Alternatives[1]; a.URL != "http://localhost:9002" || *a.Retries != 5 || *a.RetryTimeoutMs != 1000 || *a.Weight != 20 {
+		t.Errorf("unexpected alternative %+v", a)
+	}
+	if config.ConnectTimeoutMs != nil {
+		t.Error("setting left out of the file is set")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file loaded")
+	}
+	if _, err := loadConfig(writeConfig(t, `{"retry_count": "three"}`)); err == nil {
+		t.Error("invalid file loaded")
+	}
+}
+
+func TestCommandLineWinsOverConfig(t *testing.T) {
+	options.Set("rc", "7")
+	commandLineFlags = map[string]bool{"rc": true}
+	t.Cleanup(func() {
+		commandLineFlags = nil
+		applyConfig(nil)
+	})
+
+	config, err := loadConfig(writeConfig(t, `{"production": "http://localhost:9000", "alternatives": ["http://localhost:9001"], "retry_count": 2, "retry_timeout_ms": 100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewProxy(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if *retryCount != 7 || *retryTimeoutMs != 100 || *targetProduction != "http://localhost:9000" {
+		t.Errorf("-rc %d -rt %d -a %s, want the command line -rc and the rest from the file", *retryCount, *retryTimeoutMs, *targetProduction)
+	}
+	alternative := currentSettings.Load().alternatives[0]
+	if alternative.URL.String() != "http://localhost:9001" || alternative.RetryCount != 7 {
+		t.Errorf("unexpected alternative %+v", alternative)
+	}
+}
+
+func TestPerTargetRetries(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var first, second int32
+	failing := func(attempts *int32) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(attempts, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	a, b := newBackend(t, failing(&first)), newBackend(t, failing(&second))
+	config, err := loadConfig(writeConfig(t, fmt.Sprintf(`{
+		"production": %q,
+		"alternatives": [{"url": %q, "retries": 1}, {"url": %q, "retries": 4, "retry_timeout_ms": 1}],
+		"retry_count": 2,
+		"retry_timeout_ms": 1
+	}`, production.URL, a.URL, b.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestProxy(t, config)
+
+	get(t, s.URL)
+	mirrors.Wait()
+	if first != 1 || second != 4 {
+		t.Errorf("alternatives got %d and %d attempts, want 1 and 4", first, second)
+	}
+}
+
+func TestEveryOptionHasConfigField(t *testing.T) {
+	fields := map[string]bool{"b": true, "method-retries": true} // from Alternatives and MethodRetries
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		if options.Lookup(name) == nil {
+			t.Errorf("config field %s is for unknown option -%s", typ.Field(i).Name, name)
+		}
+		fields[name] = true
+	}
+	options.VisitAll(func(f *flag.Flag) {
+		if !fields[f.Name] {
+			t.Errorf("option -%s can't be set from Config", f.Name)
+		}
+	})
+
+	// options are kept apart from the flags of programs embedding the package
+	for _, name := range []string{"a", "b", "rc", "pct"} {
+		if flag.CommandLine.Lookup(name) != nil {
+			t.Errorf("option -%s registered on flag.CommandLine", name)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	t.Cleanup(func() {
+		applyConfig(nil)
+	})
+	err := applyConfig(&Config{
+		RetryCount:    ptr(5),
+		RetryJitter:   ptr(0.5),
+		StripHeaders:  []string{"Cookie", "Authorization"},
+		MirrorRPS:     ptr(2.5),
+		DryRun:        ptr(true),
+		Alternatives:  alternatives("http://localhost:9001", "http://localhost:9002"),
+		MethodRetries: map[string]int{"POST": 1, "GET": 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"rc": "5", "retry-jitter": "0.5", "mirror-rps": "2.5", "dry-run": "true",
+		"b": "http://localhost:9001,http://localhost:9002", "method-retries": "GET=4,POST=1",
+	} {
+		if got := options.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s is %q, want %q", name, got, want)
+		}
+	}
+	if got := options.Lookup("strip-header").Value.String(); !strings.Contains(got, "Cookie") || !strings.Contains(got, "Authorization") {
+		t.Errorf("-strip-header is %q", got)
+	}
+
+	// what a later config leaves out is back to its default
+	if err := applyConfig(&Config{DryRun: ptr(true)}); err != nil {
+		t.Fatal(err)
+	}
+	if *retryCount != 3 || *mirrorRps != 0 || *dryRun != true || options.Lookup("b").Value.String() != "http://localhost:8081" {
+		t.Errorf("-rc %d -mirror-rps %v -b %q after applying another config", *retryCount, *mirrorRps, options.Lookup("b").Value)
+	}
+}
+
+func TestHandlerWithoutListener(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	p := newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+
+	rec := httptest.NewRecorder()
+	p.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/orders?x=1", strings.NewReader("order")))
+	mirrors.Wait()
+	if rec.Code != http.StatusOK {
+		t.Errorf("handler answered %d", rec.Code)
+	}
+	for _, received := range []chan *http.Request{fromProduction, fromAlternative} {
+		if r := receive(t, received); r.URL.String() != "/orders?x=1" || bodyOf(r) != "order" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package tee
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// with -allow-connect a CONNECT request opens a plain TCP tunnel to production, whatever host the client asked for,
+// so tee-proxy never becomes an open proxy. Tunnels are never mirrored, their bytes mean nothing without the conversation
+func tunnelConnect(w http.ResponseWriter, r *http.Request) {
+	tunnels.Add(1)
+	defer tunnels.Done()
+	id := requestId(r)
+	atomic.AddInt64(&requestsTotal, 1)
+	addr := productionAddr(productionTarget(r))
+	logMessage(id, "INFO", fmt.Sprintf("CONNECT tunnel: <%s> to production <%s>", r.Host, addr))
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logMessage(id, "ERROR", "CONNECT not supported by connection")
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+
+	backend, err := net.DialTimeout("tcp", addr, time.Duration(*connectTimeoutMs)*time.Millisecond)
+	if err != nil {
+		logMessage(id, "ERROR", fmt.Sprintf("Could not connect to production for CONNECT: <%v>", err))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		logMessage(id, "ERROR", fmt.Sprintf("Could not hijack connection for CONNECT: <%v>", err))
+		return
+	}
+	defer client.Close()
+
+	if _, err := buffered.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		logMessage(id, "ERROR", fmt.Sprintf("Could not answer CONNECT: <%v>", err))
+		return
+	}
+
+	copyBothWays(client, buffered, backend)
+	logMessage(id, "INFO", "CONNECT tunnel closed")
+}
@@ -0,0 +1,107 @@
+package tee
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// production echoing back whatever a tunnel sends it
+func newEchoListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+// sends CONNECT over a connection of its own, returning it with the response
+func sendConnect(t *testing.T, s *httptest.Server) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+func TestConnectRejectedByDefault(t *testing.T) {
+	logs := captureLog(t)
+	production := newEchoListener(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr("http://" + production.Addr().String()), Alternatives: alternatives(alternative.URL)})
+
+	if _, _, resp := sendConnect(t, s); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("CONNECT answered %d, want 405", resp.StatusCode)
+	}
+	mirrors.Wait()
+	if len(fromAlternative) != 0 {
+		t.Error("CONNECT mirrored")
+	}
+	if !strings.Contains(logs.String(), "[CONNECT not allowed: <example.com:443> from <127.0.0.1:") {
+		t.Errorf("rejected CONNECT not logged:\n%s", logs)
+	}
+}
+
+func TestConnectTunnelsToProduction(t *testing.T) {
+	logs := captureLog(t)
+	production := newEchoListener(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr("http://" + production.Addr().String()), Alternatives: alternatives(alternative.URL), AllowConnect: ptr(true)})
+
+	conn, r, resp := sendConnect(t, s)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT answered %d, want 200", resp.StatusCode)
+	}
+	// the tunnel goes to production, whatever host was asked for
+	io.WriteString(conn, "ping\n")
+	if line, err := r.ReadString('\n'); line != "ping\n" {
+		t.Errorf("tunnel echoed %q, %v", line, err)
+	}
+	conn.Close()
+	waitFor(t, "the tunnel to close", func() bool { return strings.Contains(logs.String(), "[CONNECT tunnel closed]") })
+	mirrors.Wait()
+	if len(fromAlternative) != 0 {
+		t.Error("tunnel mirrored")
+	}
+}
+
+func TestConnectToUnreachableProduction(t *testing.T) {
+	captureLog(t)
+	production := newEchoListener(t)
+	production.Close()
+	s := newTestProxy(t, &Config{Production: ptr("http://" + production.Addr().String()), Alternatives: alternatives(), AllowConnect: ptr(true)})
+
+	if _, _, resp := sendConnect(t, s); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("CONNECT answered %d, want 502", resp.StatusCode)
+	}
+}
@@ -0,0 +1,53 @@
+package tee
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers keys seen within ttl, keeping at most size of them and evicting the least recently seen first
+type dedupCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// nil unless -dedup-header is set
+var dedup *dedupCache
+
+func newDedupCache(size int, ttl time.Duration) *dedupCache {
+	return &dedupCache{ttl: ttl, size: size, order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// reports whether key was first seen within ttl before now. Repeats don't extend the ttl, so a client retrying
+// for longer gets the request mirrored again once the ttl since the first sighting passed, which then starts anew
+func (c *dedupCache) Seen(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.keys[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		c.order.MoveToFront(e)
+		if now.Sub(entry.seen) < c.ttl {
+			return true
+		}
+		entry.seen = now
+		return false
+	}
+
+	c.keys[key] = c.order.PushFront(&dedupEntry{key: key, seen: now})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.keys, oldest.Value.(*dedupEntry).key)
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package tee
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	c := newDedupCache(2, time.Minute)
+	now := time.Now()
+	if c.Seen("a", now) {
+		t.Error("first a reported seen")
+	}
+	if !c.Seen("a", now.Add(time.Second)) {
+		t.Error("a repeated within the ttl not reported seen")
+	}
+	if c.Seen("b", now) || !c.Seen("b", now.Add(59*time.Second)) {
+		t.Error("b not remembered within the ttl")
+	}
+	// seeing b again didn't extend the ttl of its first sighting
+	if c.Seen("b", now.Add(110*time.Second)) {
+		t.Error("b remembered past the ttl although seen again within it")
+	}
+	if !c.Seen("b", now.Add(115*time.Second)) {
+		t.Error("b mirrored past the ttl not remembered again")
+	}
+	if c.Seen("a", now.Add(2*time.Minute)) {
+		t.Error("a remembered past the ttl")
+	}
+
+	// a third key evicts the least recently seen one, b here
+	c.Seen("c", now.Add(2*time.Minute))
+	if len(c.keys) != 2 || c.Seen("b", now.Add(2*time.Minute)) {
+		t.Errorf("kept %d keys, b not evicted", len(c.keys))
+	}
+}
+
+func TestDuplicateRequestsMirroredOnce(t *testing.T) {
+	logs := captureLog(t)
+	var produced, mirrored int32
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&produced, 1)
+	})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrored, 1)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), DedupHeader: ptr("Idempotency-Key")})
+
+	send := func(key string) {
+		req, _ := http.NewRequest("POST", s.URL, strings.NewReader("order"))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	send("order-1")
+	send("order-1")
+	mirrors.Wait()
+	if p, m := atomic.LoadInt32(&produced), atomic.LoadInt32(&mirrored); p != 2 || m != 1 {
+		t.Errorf("production got %d requests and alternative %d, want 2 and 1", p, m)
+	}
+	if !strings.Contains(logs.String(), "[Duplicate Idempotency-Key <order-1>, not mirroring]") {
+		t.Errorf("duplicate not logged:\n%s", logs)
+	}
+
+	// other keys and requests without one are mirrored as usual
+	for i := 0; i < 3; i++ {
+		send(fmt.Sprint("order-", i+2))
+		send("")
+	}
+	mirrors.Wait()
+	if m := atomic.LoadInt32(&mirrored); m != 7 {
+		t.Errorf("alternative got %d requests, want 7", m)
+	}
+}
+
+func TestInvalidDedupSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		if err := proxyError(t, &Config{DedupHeader: ptr("Idempotency-Key"), DedupSize: ptr(size)}); err == nil || !strings.Contains(err.Error(), "-dedup-size") {
+			t.Errorf("-dedup-size %d: unexpected error %v", size, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package tee
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+type requestURLKey struct{}
+
+// fallbackTransport retries production requests on the next of the -a fallback targets when a target can't be
+// reached or answers with 5xx, the client gets the first other response or what the last target returned
+type fallbackTransport struct {
+	http.RoundTripper
+	fallbacks []url.URL
+}
+
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// handler keeps the URL requested by the client, without it there is nothing to join fallback targets with
+	requested, ok := req.Context().Value(requestURLKey{}).(*url.URL)
+	if len(t.fallbacks) == 0 || !ok {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	// every target may need to read the body again
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	id := requestId(req)
+	current := req.URL
+	for i := 0; ; i++ {
+		out := req.Clone(req.Context())
+		out.URL = current
+		if body != nil {
+			out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.RoundTripper.RoundTrip(out)
+		if i == len(t.fallbacks) || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+
+		next := joinURL(t.fallbacks[i], requested)
+		if err != nil {
+			logMessage(id, "WARN", fmt.Sprintf("Production target %s failed: <%v>, trying fallback %s", current.Host, err, next.Host))
+		} else {
+			resp.Body.Close()
+			logMessage(id, "WARN", fmt.Sprintf("Production target %s returned %d, trying fallback %s", current.Host, resp.StatusCode, next.Host))
+		}
+		current = next
+	}
+}
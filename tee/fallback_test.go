@@ -0,0 +1,74 @@
+package tee
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFallbackProduction(t *testing.T) {
+	logs := captureLog(t)
+	failing := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "from failing")
+	})
+	down := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	down.Close()
+	healthy, fromHealthy := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(failing.URL + "," + down.URL + "," + healthy.URL + "/base")})
+
+	req, _ := http.NewRequest("PUT", s.URL+"/users/1?x=1", strings.NewReader("payload"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("client got %d, want the fallback's 200", resp.StatusCode)
+	}
+	// every target gets the whole body, joined with its own path
+	r := receive(t, fromHealthy)
+	if body := bodyOf(r); r.URL.String() != "/base/users/1?x=1" || body != "payload" {
+		t.Errorf("fallback got %s with %q", r.URL, body)
+	}
+	for _, want := range []string{"returned 503, trying fallback", "failed: <", "trying fallback " + strings.TrimPrefix(healthy.URL, "http://")} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log has no %q:\n%s", want, logs)
+		}
+	}
+}
+
+func TestFallbackProductionAllFailing(t *testing.T) {
+	captureLog(t)
+	failing := func(body string) string {
+		return newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+			io.WriteString(w, body)
+		}).URL
+	}
+	s := newTestProxy(t, &Config{Production: ptr(failing("first") + "," + failing("last"))})
+
+	// what the last target answered reaches the client
+	if resp, body := get(t, s.URL); resp.StatusCode != http.StatusBadGateway || body != "last" {
+		t.Errorf("got %d %q, want 502 from the last target", resp.StatusCode, body)
+	}
+}
+
+func TestFallbackNotUsedForHealthyPrimary(t *testing.T) {
+	captureLog(t)
+	primary := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "from primary")
+	})
+	fallback, fromFallback := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(primary.URL + "," + fallback.URL)})
+
+	if resp, body := get(t, s.URL); resp.StatusCode != http.StatusNotFound || body != "from primary" {
+		t.Errorf("got %d %q, want the primary's 404", resp.StatusCode, body)
+	}
+	if len(fromFallback) != 0 {
+		t.Error("fallback called for a 404")
+	}
+}
@@ -0,0 +1,68 @@
+package tee
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// goldenResponse is one expected response in the -golden-file, for requests with Method to Path whatever their query
+type goldenResponse struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// expected responses by method and path, nil unless -golden-file is set
+var golden map[string]*capturedResponse
+
+func goldenKey(method, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+func loadGolden(path string) (map[string]*capturedResponse, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read golden file: %v", err)
+	}
+	var responses []goldenResponse
+	if err := json.Unmarshal(b, &responses); err != nil {
+		return nil, fmt.Errorf("could not parse golden file %s: %v", path, err)
+	}
+
+	expected := make(map[string]*capturedResponse, len(responses))
+	for i, r := range responses {
+		if r.Method == "" || !strings.HasPrefix(r.Path, "/") {
+			return nil, fmt.Errorf("golden response %d in %s needs a method and a path starting with /", i+1, path)
+		}
+		if r.Status == 0 {
+			r.Status = http.StatusOK
+		}
+		header := make(http.Header)
+		for name, value := range r.Headers {
+			header.Set(name, value)
+		}
+		// alternative bodies are only compared up to -compare-max-body, so is the golden one
+		body := []byte(r.Body)
+		if len(body) > *compareMaxBody {
+			body = body[:*compareMaxBody]
+		}
+		expected[goldenKey(r.Method, r.Path)] = &capturedResponse{StatusCode: r.Status, Header: header, Body: body}
+	}
+	return expected, nil
+}
+
+// comparison of the mirrors of r with the golden response for it, nil when the file has none
+func goldenComparison(r *http.Request) *comparison {
+	response, ok := golden[goldenKey(r.Method, r.URL.Path)]
+	if !ok {
+		return nil
+	}
+	c := &comparison{done: make(chan struct{}), baseline: "golden"}
+	c.setProduction(response)
+	return c
+}
@@ -0,0 +1,89 @@
+package tee
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGoldenFile(t *testing.T) {
+	logs := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "live production\n")
+	})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", "2")
+		switch r.URL.Path {
+		case "/users":
+			fmt.Fprint(w, "user list\n")
+		case "/orders":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "broken\n")
+		default:
+			fmt.Fprint(w, "live production\n")
+		}
+	})
+	path := writeConfig(t, `[
+		{"method": "get", "path": "/users", "headers": {"X-Version": "2"}, "body": "user list\n"},
+		{"method": "GET", "path": "/orders", "headers": {"X-Version": "1"}, "body": "order list\n"}
+	]`)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), GoldenFile: ptr(path), CompareHeaders: ptr(true)})
+
+	compared := func(path string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", s.URL+path, nil)
+		req.Header.Set("X-Request-Id", strings.Trim(path, "/"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+		var lines []string
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "]["+strings.Trim(path, "/")+"-1][") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	// the golden response is the baseline, not the live production one, whatever the query
+	if log := compared("/users?page=2"); !strings.Contains(log, "[Responses match]") || strings.Contains(log, "mismatch") {
+		t.Errorf("alternative matching its golden response:\n%s", log)
+	}
+	log := compared("/orders")
+	for _, want := range []string{
+		"[Status code mismatch: golden <200> alternative <500>]",
+		`[Body mismatch: <--- golden\n+++ alternative\n@@ -1,1 +1,1 @@\n-order list\n+broken\n>]`,
+		`[Header mismatch: <~X-Version: 1 -> 2>]`,
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("%s not logged:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "Responses match") {
+		t.Errorf("alternative differing from its golden response reported as matching:\n%s", log)
+	}
+
+	// requests without a golden response aren't compared unless -compare is set
+	if log := compared("/other"); strings.Contains(log, "match") {
+		t.Errorf("request without golden response compared:\n%s", log)
+	}
+}
+
+func TestInvalidGoldenFile(t *testing.T) {
+	for content, want := range map[string]string{
+		`{"method": "GET"}`:                    "could not parse golden file",
+		`[{"path": "/users"}]`:                 "golden response 1 in",
+		`[{"method": "GET", "path": "users"}]`: "needs a method and a path starting with /",
+	} {
+		if err := proxyError(t, &Config{GoldenFile: ptr(writeConfig(t, content))}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("golden file %s: unexpected error %v", content, err)
+		}
+	}
+	if err := proxyError(t, &Config{GoldenFile: ptr("/nonexistent/golden.json")}); err == nil || !strings.HasPrefix(err.Error(), "could not read golden file") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package tee
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// health service answering every check with status, reporting each one it got
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	status   grpc_health_v1.HealthCheckResponse_ServingStatus
+	received chan *grpc_health_v1.HealthCheckRequest
+	metadata chan metadata.MD
+}
+
+func (s *healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.received <- req
+	s.metadata <- md
+	grpc.SetTrailer(ctx, metadata.Pairs("served-by", s.status.String()))
+	return &grpc_health_v1.HealthCheckResponse{Status: s.status}, nil
+}
+
+// gRPC server on a plain listener, which speaks h2c like gRPC servers without TLS do
+func newGRPCBackend(t *testing.T, status grpc_health_v1.HealthCheckResponse_ServingStatus) (string, *healthServer) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := &healthServer{status: status, received: make(chan *grpc_health_v1.HealthCheckRequest, 10), metadata: make(chan metadata.MD, 10)}
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, health)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+	return "http://" + ln.Addr().String(), health
+}
+
+func TestGRPCUnaryMirrored(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newGRPCBackend(t, grpc_health_v1.HealthCheckResponse_SERVING)
+	alternative, fromAlternative := newGRPCBackend(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	// served the way Main would, accepting h2c from the gRPC client
+	s := httptest.NewUnstartedServer(nil)
+	s.Config = newServer(newProxy(t, &Config{Production: ptr(production), Alternatives: alternatives(alternative), GRPC: ptr(true)}), listener{})
+	s.Start()
+	t.Cleanup(s.Close)
+
+	conn, err := grpc.NewClient(s.Listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	ctx := metadata.AppendToOutgoingContext(t.Context(), "x-caller", "tests")
+	var trailer metadata.MD
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "users"}, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirrors.Wait()
+	// the client gets production's answer along with its trailers
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING || len(trailer["served-by"]) != 1 || trailer["served-by"][0] != "SERVING" {
+		t.Errorf("client got %v with trailer %v", resp.Status, trailer)
+	}
+
+	for name, backend := range map[string]*healthServer{"production": fromProduction, "alternative": fromAlternative} {
+		if len(backend.received) != 1 {
+			t.Fatalf("%s got %d calls", name, len(backend.received))
+		}
+		if req, md := <-backend.received, <-backend.metadata; req.Service != "users" || len(md["x-caller"]) != 1 || md["x-caller"][0] != "tests" {
+			t.Errorf("%s got service %q with metadata %v", name, req.Service, md)
+		} else if len(md["content-type"]) != 1 || md["content-type"][0] != "application/grpc" {
+			t.Errorf("%s got content type %v", name, md["content-type"])
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package tee
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 structures, only the fields tee-proxy has data for are filled in besides the required ones
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// only the total wait for the response is known, parts not measured are -1 as HAR expects
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harArchive collects compared production and alternative exchanges in memory until written out on shutdown,
+// up to limit requests, those compared after are only counted
+type harArchive struct {
+	mu      sync.Mutex
+	entries []harEntry
+	limit   int
+	dropped int
+}
+
+// nil unless -har-out is set
+var har *harArchive
+
+// adds production and alternative exchange of one request as two consecutive entries, told apart by their comment
+func (h *harArchive) add(id string, production, alternative *capturedResponse) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.limit > 0 && len(h.entries) >= 2*h.limit {
+		h.dropped++
+		atomic.AddInt64(&harDroppedTotal, 1)
+		return
+	}
+	h.entries = append(h.entries,
+		harExchange(id+" production", production, alternative.RequestBody),
+		harExchange(id+" alternative", alternative, alternative.RequestBody),
+	)
+}
+
+func (h *harArchive) write(path string) error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := h.entries
+	if entries == nil {
+		entries = []harEntry{}
+	}
+	if h.dropped > 0 {
+		logMessage("", "WARN", fmt.Sprintf("HAR file holds the first %d compared requests, %d more were dropped", h.limit, h.dropped))
+	}
+	b, err := json.MarshalIndent(harFile{Log: harLog{Version: "1.2", Creator: harCreator{Name: "teeproxy", Version: "1.0"}, Entries: entries}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+func harExchange(comment string, response *capturedResponse, body []byte) harEntry {
+	req := response.Request
+	ms := float64(response.Duration) / float64(time.Millisecond)
+
+	entry := harEntry{
+		StartedDateTime: response.Started.Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harNameValues(req.Header),
+			QueryString: harNameValues(req.URL.Query()),
+			HeadersSize: -1,
+			BodySize:    len(body),
+		},
+		Response: harResponse{
+			Status:      response.StatusCode,
+			StatusText:  http.StatusText(response.StatusCode),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harNameValues(response.Header),
+			Content:     harBody(response.Header.Get("Content-Type"), response.Body),
+			HeadersSize: -1,
+			BodySize:    len(response.Body),
+		},
+		Timings: harTimings{Send: -1, Wait: ms, Receive: -1},
+		Comment: comment,
+	}
+	if len(body) > 0 {
+		content := harBody(req.Header.Get("Content-Type"), body)
+		entry.Request.PostData = &harPostData{MimeType: content.MimeType, Text: content.Text}
+	}
+	return entry
+}
+
+// binary bodies are base64 encoded
+func harBody(mimeType string, body []byte) harContent {
+	content := harContent{Size: len(body), MimeType: mimeType, Text: string(body)}
+	if !utf8.Valid(body) {
+		content.Text, content.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return content
+}
+
+// headers and query parameters alike, sorted by name so entries are stable
+func harNameValues(m map[string][]string) []harNameValue {
+	values := []harNameValue{}
+	for name, vs := range m {
+		for _, v := range vs {
+			values = append(values, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values
+}
@@ -0,0 +1,124 @@
+package tee
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// proxy comparing responses into a HAR file, returns the file once n requests were sent and the proxy closed
+func harOf(t *testing.T, config *Config, n int) []byte {
+	t.Helper()
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"from": "production"}`))
+	})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"from": "alternative"}`))
+	})
+	path := filepath.Join(t.TempDir(), "compared.har")
+	config.Production, config.Alternatives, config.Compare, config.HAROut = ptr(production.URL), alternatives(alternative.URL), ptr(true), ptr(path)
+	p := newProxy(t, config)
+	s := httptest.NewServer(p.Handler())
+	defer s.Close()
+
+	for i := 0; i < n; i++ {
+		resp, err := http.Post(s.URL+"/orders?page=1", "application/json", strings.NewReader(`{"id": 42}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	mirrors.Wait()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// fails unless every one of names is a field of object
+func requireFields(t *testing.T, what string, object interface{}, names ...string) map[string]interface{} {
+	t.Helper()
+	m, ok := object.(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s is %T, want an object", what, object)
+	}
+	for _, name := range names {
+		if _, ok := m[name]; !ok {
+			t.Errorf("%s misses %s", what, name)
+		}
+	}
+	return m
+}
+
+func TestHARFile(t *testing.T) {
+	captureLog(t)
+	var file interface{}
+	if err := json.Unmarshal(harOf(t, &Config{}, 1), &file); err != nil {
+		t.Fatal(err)
+	}
+
+	log := requireFields(t, "file", requireFields(t, "file", file, "log")["log"], "version", "creator", "entries")
+	if log["version"] != "1.2" {
+		t.Errorf("version %v, want 1.2", log["version"])
+	}
+	requireFields(t, "creator", log["creator"], "name", "version")
+	entries, _ := log["entries"].([]interface{})
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want production and alternative exchange", len(entries))
+	}
+
+	for i, e := range entries {
+		entry := requireFields(t, "entry", e, "startedDateTime", "time", "request", "response", "cache", "timings")
+		request := requireFields(t, "request", entry["request"], "method", "url", "httpVersion", "cookies", "headers", "queryString", "headersSize", "bodySize")
+		response := requireFields(t, "response", entry["response"], "status", "statusText", "httpVersion", "cookies", "headers", "content", "redirectURL", "headersSize", "bodySize")
+		content := requireFields(t, "content", response["content"], "size", "mimeType")
+		requireFields(t, "timings", entry["timings"], "send", "wait", "receive")
+
+		if request["method"] != "POST" || !strings.HasSuffix(request["url"].(string), "/orders?page=1") {
+			t.Errorf("entry %d request %v %v", i, request["method"], request["url"])
+		}
+		if postData, _ := request["postData"].(map[string]interface{}); postData["text"] != `{"id": 42}` {
+			t.Errorf("entry %d request body %v", i, request["postData"])
+		}
+		want := map[int]struct {
+			comment, body string
+			status        float64
+		}{0: {" production", `{"from": "production"}`, 200}, 1: {" alternative", `{"from": "alternative"}`, 201}}[i]
+		if comment, _ := entry["comment"].(string); !strings.HasSuffix(comment, want.comment) {
+			t.Errorf("entry %d comment %q, want one ending in %q", i, comment, want.comment)
+		}
+		if response["status"] != want.status || content["text"] != want.body || content["mimeType"] != "application/json" {
+			t.Errorf("entry %d response %v with %v", i, response["status"], content)
+		}
+	}
+}
+
+func TestHARMaxEntries(t *testing.T) {
+	log := captureLog(t)
+	dropped := scrapeMetric(t, "teeproxy_har_dropped_total")
+	var file harFile
+	if err := json.Unmarshal(harOf(t, &Config{HARMaxEntries: ptr(2)}, 5), &file); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(file.Log.Entries); n != 4 {
+		t.Errorf("%d entries, want 2 requests of 2 exchanges each", n)
+	}
+	if n := scrapeMetric(t, "teeproxy_har_dropped_total") - dropped; n != 3 {
+		t.Errorf("%d requests counted as dropped, want 3", n)
+	}
+	if !strings.Contains(log.String(), "HAR file holds the first 2 compared requests, 3 more were dropped") {
+		t.Errorf("dropped requests not logged: %s", log)
+	}
+}
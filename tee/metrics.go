@@ -0,0 +1,292 @@
+package tee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counters are updated with sync/atomic from the proxy and mirror goroutines
+var (
+	requestsTotal          int64
+	mirroredRequestsTotal  int64
+	mirrorRetriesTotal     int64
+	mirrorErrorsTotal      int64
+	mirrorDropsTotal       int64
+	mirrorRateLimitedTotal int64
+	mirrorCircuitOpenTotal int64
+	assertFailuresTotal    int64
+	mirrorDuplicatesTotal  int64
+	comparisonsTotal       int64
+	queueWarningsTotal     int64
+	slowMirrorsTotal       int64
+	oversizedHeadersTotal  int64
+	oversizedBodiesTotal   int64
+	mirrorPanicsTotal      int64
+	harDroppedTotal        int64
+
+	// mirrors currently being sent, not counting those waiting in the queue
+	mirrorsInFlight int64
+
+	// production responses sent to clients by status class, 1xx at index 1 to 5xx at index 5
+	productionResponsesTotal     [6]int64
+	productionResponseBytesTotal int64
+
+	// failed mirrors by cause, indexed like failureClasses
+	mirrorFailuresTotal [len(failureClasses)]int64
+
+	startTime = time.Now()
+
+	alternativeLatency = newHistogram([]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+	// latencies of the current -stats-interval only, for logging percentiles
+	latencySample = newReservoir(1024)
+)
+
+// causes mirrors fail for: a host name that doesn't resolve, no response in time, a connection that couldn't be made
+// or broke, retries giving up on a 5xx response and anything else, e.g. a failed TLS handshake or retries giving up on a 429
+var failureClasses = [...]string{"dns", "timeout", "connection", "5xx", "other"}
+
+const (
+	failureDNS = iota
+	failureTimeout
+	failureConnection
+	failureServerError
+	failureOther
+)
+
+// classifies an error returned by the transport, more specific causes are checked first
+// as a DNS error is a net.Error too and can also time out
+func failureClass(err error) int {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return failureDNS
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return failureTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return failureConnection
+	}
+	return failureOther
+}
+
+// counts a failed mirror, each one is counted once in total and once for its cause
+func countFailure(class int) {
+	atomic.AddInt64(&mirrorErrorsTotal, 1)
+	atomic.AddInt64(&mirrorFailuresTotal[class], 1)
+}
+
+// statuses outside of 100-599 aren't counted by class, their bytes are
+func countProductionResponse(status int, bytes int64) {
+	if class := status / 100; class >= 1 && class <= 5 {
+		atomic.AddInt64(&productionResponsesTotal[class], 1)
+	}
+	atomic.AddInt64(&productionResponseBytesTotal, bytes)
+}
+
+// histogram is a minimal Prometheus style histogram with cumulative buckets, values are in seconds
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, upper, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// reservoir keeps a uniform random sample of at most size values out of all observed (algorithm R),
+// so percentiles can be estimated in constant memory
+type reservoir struct {
+	mu     sync.Mutex
+	values []float64
+	seen   int64
+	size   int
+}
+
+func newReservoir(size int) *reservoir {
+	return &reservoir{values: make([]float64, 0, size), size: size}
+}
+
+func (r *reservoir) Observe(v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seen++
+	if len(r.values) < r.size {
+		r.values = append(r.values, v)
+	} else if i := rand.Int63n(r.seen); i < int64(r.size) {
+		r.values[i] = v
+	}
+}
+
+// returns the requested percentiles of the sample and how many values were observed, then starts over
+func (r *reservoir) reset(percentiles ...float64) ([]float64, int64) {
+	r.mu.Lock()
+	values, seen := r.values, r.seen
+	r.values, r.seen = make([]float64, 0, r.size), 0
+	r.mu.Unlock()
+
+	result := make([]float64, len(percentiles))
+	if len(values) == 0 {
+		return result, seen
+	}
+	sort.Float64s(values)
+	for i, p := range percentiles {
+		index := int(math.Ceil(p/100*float64(len(values)))) - 1
+		if index < 0 {
+			index = 0
+		}
+		result[i] = values[index]
+	}
+	return result, seen
+}
+
+// logs alternative latency percentiles of each interval, intervals without mirrors are skipped
+func reportLatency(interval time.Duration) {
+	for range time.Tick(interval) {
+		p, count := latencySample.reset(50, 90, 99)
+		if count == 0 {
+			continue
+		}
+		seconds := func(v float64) time.Duration { return time.Duration(v * float64(time.Second)) }
+		logMessage("", "INFO", fmt.Sprintf("Mirror latency: p50 <%v> p90 <%v> p99 <%v> over <%d> responses", seconds(p[0]), seconds(p[1]), seconds(p[2]), count))
+	}
+}
+
+func writeCounter(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func writeGauge(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// serves metrics in the Prometheus text exposition format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeCounter(w, "teeproxy_requests_total", "Total number of requests proxied to production.", atomic.LoadInt64(&requestsTotal))
+	fmt.Fprintf(w, "# HELP teeproxy_production_responses_total Total number of production responses sent to clients by status class.\n# TYPE teeproxy_production_responses_total counter\n")
+	for class := 1; class <= 5; class++ {
+		fmt.Fprintf(w, "teeproxy_production_responses_total{code=\"%dxx\"} %d\n", class, atomic.LoadInt64(&productionResponsesTotal[class]))
+	}
+	writeCounter(w, "teeproxy_oversized_headers_total", "Total number of requests answered with 431 because of -max-header-bytes.", atomic.LoadInt64(&oversizedHeadersTotal))
+	writeCounter(w, "teeproxy_production_response_bytes_total", "Total number of production response body bytes sent to clients.", atomic.LoadInt64(&productionResponseBytesTotal))
+	writeCounter(w, "teeproxy_mirrored_requests_total", "Total number of requests mirrored to alternative destinations.", atomic.LoadInt64(&mirroredRequestsTotal))
+	writeCounter(w, "teeproxy_mirror_retries_total", "Total number of retried mirror requests.", atomic.LoadInt64(&mirrorRetriesTotal))
+	writeCounter(w, "teeproxy_mirror_errors_total", "Total number of mirror requests that failed.", atomic.LoadInt64(&mirrorErrorsTotal))
+	fmt.Fprintf(w, "# HELP teeproxy_mirror_failures_total Total number of mirror requests that failed by cause.\n# TYPE teeproxy_mirror_failures_total counter\n")
+	for i, class := range failureClasses {
+		fmt.Fprintf(w, "teeproxy_mirror_failures_total{class=\"%s\"} %d\n", class, atomic.LoadInt64(&mirrorFailuresTotal[i]))
+	}
+	writeCounter(w, "teeproxy_mirror_panics_total", "Total number of mirror requests that panicked and were recovered.", atomic.LoadInt64(&mirrorPanicsTotal))
+	writeCounter(w, "teeproxy_mirror_dropped_total", "Total number of mirror requests dropped because the mirror queue was full.", atomic.LoadInt64(&mirrorDropsTotal))
+	writeGauge(w, "teeproxy_mirror_queue_depth", "Number of mirror requests waiting for a worker.", int64(len(mirrorQueue)))
+	writeCounter(w, "teeproxy_mirror_queue_warnings_total", "Total number of times the mirror queue grew above -queue-warn-threshold.", atomic.LoadInt64(&queueWarningsTotal))
+	writeCounter(w, "teeproxy_mirror_rate_limited_total", "Total number of requests not mirrored because of -mirror-rps.", atomic.LoadInt64(&mirrorRateLimitedTotal))
+	writeCounter(w, "teeproxy_mirror_circuit_open_total", "Total number of mirror requests skipped because circuit breaker was open.", atomic.LoadInt64(&mirrorCircuitOpenTotal))
+	writeCounter(w, "teeproxy_mirror_oversized_total", "Total number of requests not mirrored because their body exceeds -max-mirror-body.", atomic.LoadInt64(&oversizedBodiesTotal))
+	writeCounter(w, "teeproxy_mirror_duplicates_total", "Total number of requests not mirrored because of a repeated -dedup-header value.", atomic.LoadInt64(&mirrorDuplicatesTotal))
+	writeCounter(w, "teeproxy_comparisons_total", "Total number of requests whose responses are compared.", atomic.LoadInt64(&comparisonsTotal))
+	writeCounter(w, "teeproxy_har_dropped_total", "Total number of compared requests left out of the -har-out file because of -har-max-entries.", atomic.LoadInt64(&harDroppedTotal))
+	writeCounter(w, "teeproxy_latency_regressions_total", "Total number of alternative responses slower than -latency-regression-factor allows.", atomic.LoadInt64(&slowMirrorsTotal))
+	writeCounter(w, "teeproxy_assert_failures_total", "Total number of alternative responses failing -assert-cmd.", atomic.LoadInt64(&assertFailuresTotal))
+	alternativeLatency.write(w, "teeproxy_alternative_response_seconds", "Response latency of alternative destinations.")
+}
+
+type stats struct {
+	Uptime          string  `json:"uptime"`
+	UptimeSeconds   float64 `json:"uptime_seconds"`
+	Requests        int64   `json:"requests"`
+	ResponseBytes   int64   `json:"response_bytes"`
+	Mirrored        int64   `json:"mirrored"`
+	Dropped         int64   `json:"dropped"`
+	MirrorErrors    int64   `json:"mirror_errors"`
+	MirrorPanics    int64   `json:"mirror_panics"`
+	MirrorsInFlight int64   `json:"mirrors_in_flight"`
+	QueueDepth      int     `json:"queue_depth"`
+	// mirror errors by cause, see failureClasses
+	MirrorFailures map[string]int64 `json:"mirror_failures"`
+	// production responses by status class, "2xx" and so on
+	Responses map[string]int64 `json:"responses"`
+}
+
+// same counters as the metrics endpoint, but readable without a Prometheus server
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	uptime := time.Since(startTime)
+	failures := make(map[string]int64, len(failureClasses))
+	for i, class := range failureClasses {
+		failures[class] = atomic.LoadInt64(&mirrorFailuresTotal[i])
+	}
+	responses := make(map[string]int64, 5)
+	for class := 1; class <= 5; class++ {
+		responses[fmt.Sprintf("%dxx", class)] = atomic.LoadInt64(&productionResponsesTotal[class])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats{
+		Uptime:          uptime.Round(time.Second).String(),
+		UptimeSeconds:   uptime.Seconds(),
+		Requests:        atomic.LoadInt64(&requestsTotal),
+		Mirrored:        atomic.LoadInt64(&mirroredRequestsTotal),
+		Dropped:         atomic.LoadInt64(&mirrorDropsTotal),
+		MirrorErrors:    atomic.LoadInt64(&mirrorErrorsTotal),
+		MirrorPanics:    atomic.LoadInt64(&mirrorPanicsTotal),
+		MirrorsInFlight: atomic.LoadInt64(&mirrorsInFlight),
+		QueueDepth:      len(mirrorQueue),
+		MirrorFailures:  failures,
+		Responses:       responses,
+		ResponseBytes:   atomic.LoadInt64(&productionResponseBytesTotal),
+	})
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logMessage("", "ERROR", fmt.Sprintf("Metrics server failed: <%v>", err))
+	}
+}
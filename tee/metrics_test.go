@@ -0,0 +1,260 @@
+package tee
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// value of the sample named name, labels included, on the metrics page
+func scrapeMetric(t *testing.T, name string) int64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), name+" "); ok {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid value of %s: %v", name, err)
+			}
+			return int64(n)
+		}
+	}
+	t.Fatalf("no %s metric", name)
+	return 0
+}
+
+func TestMetricsCountersMove(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), RetryCount: ptr(2), RetryTimeoutMs: ptr(1)})
+
+	names := []string{"teeproxy_requests_total", "teeproxy_mirrored_requests_total", "teeproxy_mirror_retries_total", "teeproxy_mirror_errors_total", `teeproxy_production_responses_total{code="2xx"}`}
+	before := make(map[string]int64)
+	for _, name := range names {
+		before[name] = scrapeMetric(t, name)
+	}
+	for i := 0; i < 3; i++ {
+		get(t, s.URL)
+	}
+	mirrors.Wait()
+
+	for _, name := range names {
+		if moved := scrapeMetric(t, name) - before[name]; moved != 3 {
+			t.Errorf("%s moved by %d, want 3", name, moved)
+		}
+	}
+	if latency := scrapeMetric(t, "teeproxy_alternative_response_seconds_count"); latency < 6 {
+		t.Errorf("%d alternative latencies observed, want at least 6", latency)
+	}
+}
+
+func fetchStats(t *testing.T, url string) stats {
+	t.Helper()
+	resp, body := get(t, url)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("stats answered %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var s stats
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		t.Fatalf("invalid stats %s: %v", body, err)
+	}
+	return s
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), StatsPath: ptr("/_stats"), RetryCount: ptr(1)})
+
+	before := fetchStats(t, s.URL+"/_stats")
+	for i := 0; i < 4; i++ {
+		get(t, s.URL)
+	}
+	mirrors.Wait()
+	after := fetchStats(t, s.URL+"/_stats")
+
+	// the stats requests themselves are neither counted nor mirrored
+	if n := after.Requests - before.Requests; n != 4 {
+		t.Errorf("%d requests counted, want 4", n)
+	}
+	if n := after.Mirrored - before.Mirrored; n != 4 {
+		t.Errorf("%d mirrored, want 4", n)
+	}
+	if n := after.MirrorErrors - before.MirrorErrors; n != 4 {
+		t.Errorf("%d mirror errors, want 4", n)
+	}
+	if n := after.Responses["2xx"] - before.Responses["2xx"]; n != 4 {
+		t.Errorf("%d 2xx production responses, want 4", n)
+	}
+	if n := after.ResponseBytes - before.ResponseBytes; n != 20 {
+		t.Errorf("%d production response bytes, want 20", n)
+	}
+	if after.MirrorsInFlight != 0 || after.UptimeSeconds <= 0 || after.Uptime == "" {
+		t.Errorf("unexpected stats %+v", after)
+	}
+}
+
+func TestReservoirPercentiles(t *testing.T) {
+	// 1ms to 1s in steps of 1ms, all kept by a reservoir that large
+	r := newReservoir(1024)
+	for i := 1000; i > 0; i-- {
+		r.Observe(float64(i) / 1000)
+	}
+	p, count := r.reset(50, 90, 99)
+	if count != 1000 || p[0] != 0.5 || p[1] != 0.9 || p[2] != 0.99 {
+		t.Errorf("got %v over %d values, want [0.5 0.9 0.99] over 1000", p, count)
+	}
+	if p, count := r.reset(50); count != 0 || p[0] != 0 {
+		t.Errorf("reset kept %d values, p50 %v", count, p[0])
+	}
+
+	// a sample of 200 out of 100000 only estimates them
+	r = newReservoir(200)
+	for i := 0; i < 100000; i++ {
+		r.Observe(float64(i%1000) / 1000)
+	}
+	p, count = r.reset(50, 90, 99)
+	if count != 100000 || len(r.values) != 0 {
+		t.Errorf("observed %d values, %d left after reset", count, len(r.values))
+	}
+	for i, want := range []float64{0.5, 0.9, 0.99} {
+		if p[i] < want-0.1 || p[i] > want+0.1 {
+			t.Errorf("percentile %d estimated %v, want about %v", i, p[i], want)
+		}
+	}
+}
+
+func TestMirrorLatencySampled(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+	latencySample.reset()
+
+	for i := 0; i < 10; i++ {
+		path := "/fast"
+		if i == 0 {
+			path = "/slow"
+		}
+		get(t, s.URL+path)
+	}
+	mirrors.Wait()
+	p, count := latencySample.reset(50, 99)
+	if count != 10 || p[0] >= 0.1 || p[1] < 0.1 {
+		t.Errorf("p50 %v p99 %v over %d mirrors, want one of 10 taking 100ms", p[0], p[1], count)
+	}
+}
+
+func TestFailureClass(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&url.Error{Op: "Get", URL: "http://missing.invalid", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "missing.invalid", IsNotFound: true}}}, "dns"},
+		{&url.Error{Op: "Get", URL: "http://slow", Err: context.DeadlineExceeded}, "timeout"},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, "timeout"},
+		{&url.Error{Op: "Get", URL: "http://down", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, "connection"},
+		{fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), "connection"},
+		{errors.New("tls: handshake failure"), "other"},
+	} {
+		if got := failureClasses[failureClass(tc.err)]; got != tc.want {
+			t.Errorf("%v classified %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestMirrorFailuresCountedByClass(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	release := make(chan struct{})
+	slow := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	t.Cleanup(func() {
+		close(release)
+	})
+	down := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	down.Close()
+	failing := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), RetryCount: ptr(1), HeaderTimeoutMs: ptr(100),
+		Alternatives: alternatives("http://teeproxy-test.invalid", slow.URL, down.URL, failing.URL)})
+
+	failures := func() map[string]int64 {
+		counts := make(map[string]int64)
+		for _, class := range failureClasses {
+			counts[class] = scrapeMetric(t, `teeproxy_mirror_failures_total{class="`+class+`"}`)
+		}
+		return counts
+	}
+	before := failures()
+	get(t, s.URL)
+	mirrors.Wait()
+	after := failures()
+
+	// one mirror failing for each cause, an unresolvable host isn't taken for a timeout
+	for class, want := range map[string]int64{"dns": 1, "timeout": 1, "connection": 1, "5xx": 1, "other": 0} {
+		if got := after[class] - before[class]; got != want {
+			t.Errorf("%d %s failures counted, want %d", got, class, want)
+		}
+	}
+}
+
+func TestMirrorPanicsCounted(t *testing.T) {
+	logs := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), StatsPath: ptr("/_stats")})
+	before, panics := fetchStats(t, s.URL+"/_stats"), scrapeMetric(t, "teeproxy_mirror_panics_total")
+
+	// a mirror request without URL can't be sent, clientCall dereferencing it panics
+	mirrorStarted()
+	clientCall("broken", &settingsOf(httptest.NewRequest("GET", "/", nil)).alternatives[0], &http.Request{Method: "GET", Header: make(http.Header)}, newRequestBody(1), nil)
+	mirrors.Wait()
+	if n := scrapeMetric(t, "teeproxy_mirror_panics_total") - panics; n != 1 {
+		t.Errorf("%d panics counted, want 1", n)
+	}
+	if after := fetchStats(t, s.URL+"/_stats"); after.MirrorPanics-before.MirrorPanics != 1 || after.MirrorsInFlight != 0 {
+		t.Errorf("stats report %d panics and %d mirrors in flight", after.MirrorPanics-before.MirrorPanics, after.MirrorsInFlight)
+	}
+	if !strings.Contains(logs.String(), "[broken][ERROR][Recovered in clientCall: <runtime error: invalid memory address or nil pointer dereference>") {
+		t.Errorf("panic not logged:\n%s", logs)
+	}
+
+	// the proxy goes on mirroring
+	if resp, _ := get(t, s.URL+"/after"); resp.StatusCode != http.StatusOK {
+		t.Errorf("answered %d after a panic", resp.StatusCode)
+	}
+	mirrors.Wait()
+	if r := receive(t, fromAlternative); r.URL.Path != "/after" {
+		t.Errorf("mirrored %s after a panic", r.URL.Path)
+	}
+}
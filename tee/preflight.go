@@ -0,0 +1,43 @@
+package tee
+
+import (
+	"fmt"
+)
+
+// probes production and every alternative once, false when a destination listed in abortOn can't be reached
+func preflight(abortOn []string) bool {
+	abort := map[string]bool{}
+	for _, name := range abortOn {
+		abort[name] = true
+	}
+
+	ok := true
+	check := func(kind, label, name string, err error) {
+		if err == nil {
+			logMessage("", "INFO", fmt.Sprintf("Preflight %s reachable: <%s>", label, name))
+			return
+		}
+		level := "WARN"
+		if abort[kind] {
+			level, ok = "ERROR", false
+		}
+		logMessage("", level, fmt.Sprintf("Preflight %s unreachable: <%s> <%v>", label, name, err))
+	}
+
+	check("production", "production", hosts.Target.String(), probeProduction())
+	alternatives := currentSettings.Load().alternatives
+	for i := range alternatives {
+		target := &alternatives[i]
+		transport := target.Transport
+		if transport == nil {
+			transport = altTransport
+		}
+		name := target.URL.String()
+		if target.SocketPath != "" {
+			name = "unix:" + target.SocketPath
+		}
+		check("alternatives", "alternative", name, probe(target.URL, transport))
+	}
+
+	return ok
+}
@@ -0,0 +1,37 @@
+package tee
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	up := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	down.Close()
+
+	for _, tc := range []struct {
+		name                    string
+		production, alternative string
+		abortOn                 []string
+		ok                      bool
+		logged                  string
+	}{
+		{"all reachable", up.URL, up.URL, []string{"production", "alternatives"}, true, "[INFO][Preflight alternative reachable: <" + up.URL + ">]"},
+		{"production down", down.URL, up.URL, []string{"production"}, false, "[ERROR][Preflight production unreachable: <" + down.URL + ">"},
+		{"alternative down", up.URL, down.URL, []string{"production"}, true, "[WARN][Preflight alternative unreachable: <" + down.URL + ">"},
+		{"alternative down aborting", up.URL, down.URL, []string{"alternatives"}, false, "[ERROR][Preflight alternative unreachable: <" + down.URL + ">"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log := captureLog(t)
+			newProxy(t, &Config{Production: ptr(tc.production), Alternatives: alternatives(tc.alternative)})
+			if ok := preflight(tc.abortOn); ok != tc.ok {
+				t.Errorf("preflight passed %v, want %v", ok, tc.ok)
+			}
+			if !strings.Contains(log.String(), tc.logged) {
+				t.Errorf("log misses %s: %s", tc.logged, log)
+			}
+		})
+	}
+}
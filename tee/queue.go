@@ -0,0 +1,90 @@
+package tee
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// mirrorJob is one duplicated request waiting to be sent to an alternative destination
+type mirrorJob struct {
+	id     string
+	target *Alternative
+	req    *http.Request
+	body   *requestBody
+	c      *comparison
+}
+
+// with -workers set mirrors are sent by a fixed pool of workers consuming this queue,
+// otherwise it stays nil and every mirror gets its own goroutine
+var mirrorQueue chan mirrorJob
+
+func startMirrorWorkers(workers, queueSize int) {
+	mirrorQueue = make(chan mirrorJob, queueSize)
+	for i := 0; i < workers; i++ {
+		go mirrorWorker()
+	}
+}
+
+func mirrorWorker() {
+	for job := range mirrorQueue {
+		clientCall(job.id, job.target, job.req, job.body, job.c)
+	}
+}
+
+// hands job over to the worker pool, when the queue is full either the new job or the one queued longest is dropped depending on -drop-policy
+func enqueueMirror(job mirrorJob) {
+	mirrorStarted()
+
+	if mirrorQueue == nil {
+		go clientCall(job.id, job.target, job.req, job.body, job.c)
+		return
+	}
+
+	for {
+		select {
+		case mirrorQueue <- job:
+			checkQueueDepth(job.id)
+			return
+		default:
+		}
+
+		if *dropPolicy != "oldest" {
+			dropMirror(job)
+			return
+		}
+
+		select {
+		case oldest := <-mirrorQueue:
+			dropMirror(oldest)
+		default:
+			// workers emptied a slot meanwhile, try queueing again
+		}
+	}
+}
+
+func dropMirror(job mirrorJob) {
+	atomic.AddInt64(&mirrorDropsTotal, 1)
+	job.body.release()
+	job.target.Breaker.Abort()
+	mirrorFinished()
+	logMessage(job.id, "WARN", "Mirror queue full, dropping request")
+}
+
+// set while the queue is above -queue-warn-threshold, so crossing it is logged and counted once until it drains below again
+var queueOverThreshold int32
+
+func checkQueueDepth(id string) {
+	if *queueWarn <= 0 {
+		return
+	}
+	depth := len(mirrorQueue)
+	if depth <= *queueWarn {
+		atomic.StoreInt32(&queueOverThreshold, 0)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&queueOverThreshold, 0, 1) {
+		atomic.AddInt64(&queueWarningsTotal, 1)
+		logMessage(id, "WARN", fmt.Sprintf("Mirror queue holds %d requests, above threshold of %d", depth, *queueWarn))
+	}
+}
@@ -0,0 +1,144 @@
+package tee
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// alternative holding every request until release is closed, reporting their paths in the order they arrived
+func newBlockingBackend(t *testing.T) (url string, paths func() []string, release chan struct{}) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []string
+	release = make(chan struct{})
+	s := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.URL.Path)
+		mu.Unlock()
+		<-release
+	})
+	// requests still held would keep the server from closing
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	return s.URL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}, release
+}
+
+func TestWorkerPoolBoundsConcurrentMirrors(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var mu sync.Mutex
+	var running, most int
+	release := make(chan struct{})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), Workers: ptr(2), QueueSize: ptr(10)})
+
+	for i := 0; i < 6; i++ {
+		get(t, s.URL)
+	}
+	waitFor(t, "workers to pick up mirrors", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running == 2
+	})
+	if depth := len(mirrorQueue); depth != 4 {
+		t.Errorf("%d mirrors queued, want 4", depth)
+	}
+	close(release)
+	mirrors.Wait()
+	if most != 2 {
+		t.Errorf("%d mirrors sent at once by 2 workers", most)
+	}
+}
+
+func TestDropPolicies(t *testing.T) {
+	for policy, want := range map[string][]string{"newest": {"/a", "/b"}, "oldest": {"/a", "/c"}} {
+		t.Run(policy, func(t *testing.T) {
+			captureLog(t)
+			production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+			alternative, paths, release := newBlockingBackend(t)
+			s := newTestProxy(t, &Config{
+				Production:   ptr(production.URL),
+				Alternatives: alternatives(alternative),
+				Workers:      ptr(1),
+				QueueSize:    ptr(1),
+				DropPolicy:   ptr(policy),
+			})
+			dropped := scrapeMetric(t, "teeproxy_mirror_dropped_total")
+
+			// /a keeps the only worker busy, /b fills the queue and /c finds it full
+			get(t, s.URL+"/a")
+			waitFor(t, "the worker to send /a", func() bool { return len(paths()) == 1 })
+			get(t, s.URL+"/b")
+			get(t, s.URL+"/c")
+			close(release)
+			mirrors.Wait()
+
+			if got := paths(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("alternative got %v, want %v", got, want)
+			}
+			if n := scrapeMetric(t, "teeproxy_mirror_dropped_total") - dropped; n != 1 {
+				t.Errorf("%d drops counted, want 1", n)
+			}
+		})
+	}
+}
+
+func TestQueueWarnThreshold(t *testing.T) {
+	logs := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative, paths, release := newBlockingBackend(t)
+	s := newTestProxy(t, &Config{
+		Production:         ptr(production.URL),
+		Alternatives:       alternatives(alternative),
+		Workers:            ptr(1),
+		QueueSize:          ptr(10),
+		QueueWarnThreshold: ptr(2),
+	})
+	warnings := scrapeMetric(t, "teeproxy_mirror_queue_warnings_total")
+
+	// the first one keeps the only worker busy, the other five wait in the queue
+	get(t, s.URL+"/0")
+	waitFor(t, "the worker to send /0", func() bool { return len(paths()) == 1 })
+	for i := 1; i <= 5; i++ {
+		get(t, s.URL+fmt.Sprintf("/%d", i))
+	}
+	if depth := scrapeMetric(t, "teeproxy_mirror_queue_depth"); depth != 5 {
+		t.Errorf("queue depth %d, want 5", depth)
+	}
+	close(release)
+	mirrors.Wait()
+
+	// staying above the threshold is warned about once
+	if n := scrapeMetric(t, "teeproxy_mirror_queue_warnings_total") - warnings; n != 1 {
+		t.Errorf("%d warnings counted, want 1", n)
+	}
+	if n := strings.Count(logs.String(), "[Mirror queue holds 3 requests, above threshold of 2]"); n != 1 {
+		t.Errorf("warning logged %d times:\n%s", n, logs)
+	}
+	if depth := scrapeMetric(t, "teeproxy_mirror_queue_depth"); depth != 0 {
+		t.Errorf("queue depth %d once drained", depth)
+	}
+}
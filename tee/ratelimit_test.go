@@ -0,0 +1,103 @@
+package tee
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 5)
+	now := b.last
+	allowed := func(at time.Time, n int) int {
+		got := 0
+		for i := 0; i < n; i++ {
+			if b.Allow(at) {
+				got++
+			}
+		}
+		return got
+	}
+
+	if got := allowed(now, 10); got != 5 {
+		t.Errorf("burst allowed %d, want 5", got)
+	}
+	if got := allowed(now.Add(100*time.Millisecond), 10); got != 1 {
+		t.Errorf("100ms at 10/s allowed %d more, want 1", got)
+	}
+	// a long pause only refills up to the burst
+	if got := allowed(now.Add(time.Hour), 10); got != 5 {
+		t.Errorf("allowed %d after an hour, want the burst of 5", got)
+	}
+}
+
+func TestMirrorRateLimit(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var mirrored int64
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&mirrored, 1)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MirrorRPS: ptr(20.0), MirrorBurst: ptr(5)})
+	limited := scrapeMetric(t, "teeproxy_mirror_rate_limited_total")
+
+	requests := 0
+	start := time.Now()
+	for time.Since(start) < 500*time.Millisecond {
+		if resp, _ := get(t, s.URL); resp.StatusCode != http.StatusOK {
+			t.Fatalf("production answered %d", resp.StatusCode)
+		}
+		requests++
+	}
+	elapsed := time.Since(start)
+	mirrors.Wait()
+
+	// the burst plus 20 a second, production got every request regardless
+	n := atomic.LoadInt64(&mirrored)
+	if most := int64(5 + 20*elapsed.Seconds() + 1); n < 5 || n > most {
+		t.Errorf("mirrored %d of %d requests in %v, want between 5 and %d", n, requests, elapsed, most)
+	}
+	if skipped := scrapeMetric(t, "teeproxy_mirror_rate_limited_total") - limited; skipped != int64(requests)-n {
+		t.Errorf("counted %d rate limited requests, want %d", skipped, int64(requests)-n)
+	}
+}
+
+func TestSkippedRequestsDontUseRateLimit(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MirrorRPS: ptr(0.001), MirrorBurst: ptr(2), DedupHeader: ptr("Idempotency-Key"), MaxMirrorBody: ptr(int64(10))})
+	limited := scrapeMetric(t, "teeproxy_mirror_rate_limited_total")
+
+	send := func(path, key, body string) {
+		req, _ := http.NewRequest("POST", s.URL+path, strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+	}
+	// the burst of 2 is left for the first and the last request, both others are skipped before they need a token
+	send("/first", "a", "")
+	send("/duplicate", "a", "")
+	send("/oversized", "b", strings.Repeat("x", 100))
+	send("/last", "c", "")
+	for _, want := range []string{"/first", "/last"} {
+		if r := receive(t, fromAlternative); r.URL.Path != want {
+			t.Errorf("mirrored %s, want %s", r.URL.Path, want)
+		}
+	}
+	if n := scrapeMetric(t, "teeproxy_mirror_rate_limited_total") - limited; n != 0 {
+		t.Errorf("%d requests rate limited, want none", n)
+	}
+
+	// tokens are used up now
+	send("/limited", "d", "")
+	if len(fromAlternative) != 0 || scrapeMetric(t, "teeproxy_mirror_rate_limited_total")-limited != 1 {
+		t.Error("request over the rate limit mirrored")
+	}
+}
@@ -0,0 +1,69 @@
+package tee
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// requestRecorder appends mirrored requests to a file in the format -replay reads,
+// a mutex keeps requests recorded concurrently from interleaving
+type requestRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// nil unless -record is set
+var recorder *requestRecorder
+
+func newRequestRecorder(path string) (*requestRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &requestRecorder{file: f}, nil
+}
+
+// writes req as received by the proxy with the body mirrors got, so replaying applies rewrites and filters again
+func (r *requestRecorder) record(id string, req *http.Request, body *requestBody) {
+	if r == nil {
+		return
+	}
+
+	dumped := req.Clone(req.Context())
+	// the URI as received still carries -base-path, which replaying would not strip again
+	dumped.RequestURI = ""
+	dumped.Body = ioutil.NopCloser(body.Reader())
+	dumped.ContentLength = body.Len()
+	dumped.TransferEncoding = nil
+	dumped.Trailer = nil
+	dumped.Header.Del("Content-Length")
+	if body.Len() > 0 {
+		dumped.Header.Set("Content-Length", strconv.FormatInt(body.Len(), 10))
+	}
+
+	dump, err := httputil.DumpRequest(dumped, true)
+	if err != nil {
+		logMessage(id, "ERROR", fmt.Sprintf("Could not record request: <%v>", err))
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(dump, "\r\n"...)); err != nil {
+		logMessage(id, "ERROR", fmt.Sprintf("Could not record request: <%v>", err))
+	}
+}
+
+func (r *requestRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
@@ -0,0 +1,69 @@
+package tee
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecordedRequestsParseBack(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	path := filepath.Join(t.TempDir(), "recorded.dump")
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), Record: ptr(path)})
+
+	// recorded concurrently, every request has to come out whole
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", fmt.Sprintf("%s/items/%d", s.URL, i), strings.NewReader(fmt.Sprintf("body of item %d", i)))
+			req.Header.Set("X-Item", fmt.Sprint(i))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(i)
+	}
+	wg.Wait()
+	mirrors.Wait()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	seen := map[string]bool{}
+	for {
+		for b, err := reader.Peek(1); err == nil && (b[0] == '\r' || b[0] == '\n'); b, err = reader.Peek(1) {
+			reader.ReadByte()
+		}
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			t.Fatalf("could not parse recorded request %d: %v", len(seen)+1, err)
+		}
+		body, _ := io.ReadAll(req.Body)
+		item := req.Header.Get("X-Item")
+		if req.Method != "POST" || req.URL.Path != "/items/"+item || string(body) != "body of item "+item {
+			t.Errorf("recorded %s %s with X-Item %s and body %q", req.Method, req.URL.Path, item, body)
+		}
+		seen[item] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("%d distinct requests recorded, want 20", len(seen))
+	}
+}
@@ -0,0 +1,139 @@
+package tee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// settings a SIGHUP reloads from the -config file: sampling, alternatives and their retries. A snapshot is never
+// changed once stored, handler takes the current one for a request and its mirrors keep it until they are done,
+// so a reload never gives them a mix of old and new settings
+type settings struct {
+	percent       int
+	sampler       Sampler
+	alternatives  []Alternative
+	methodRetries map[string]int
+}
+
+var currentSettings atomic.Pointer[settings]
+
+type settingsKey struct{}
+
+// snapshot request started with, the current one for requests that didn't come through handler like replayed ones
+func settingsOf(r *http.Request) *settings {
+	if s, ok := r.Context().Value(settingsKey{}).(*settings); ok {
+		return s
+	}
+	return currentSettings.Load()
+}
+
+func withSettings(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), settingsKey{}, currentSettings.Load()))
+}
+
+// builds a snapshot from flags and config, breakers and socket transports of alternatives in previous are kept
+// for the same targets, so a reload doesn't close a circuit that is open or drop idle connections
+func newSettings(config *Config, alternatives []string, previous *settings) (*settings, error) {
+	if *retryCount < 0 {
+		return nil, fmt.Errorf("invalid -rc value %d, must be 0 or more", *retryCount)
+	}
+	if *mirrorPercent < 0 || *mirrorPercent > 100 {
+		return nil, fmt.Errorf("invalid -pct value %d, must be between 0 and 100", *mirrorPercent)
+	}
+	targets := make([]url.URL, 0, len(alternatives))
+	for _, a := range alternatives {
+		target, err := parseTarget("alternative", a)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	methodRetries, err := parseMethodRetries(*methodRetryList)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &settings{
+		percent:       *mirrorPercent,
+		sampler:       flagSampler,
+		alternatives:  buildAlternatives(targets, config),
+		methodRetries: methodRetries,
+	}
+	if config != nil && len(config.Sampling) > 0 {
+		chain, err := buildSampler(config.Sampling)
+		if err != nil {
+			return nil, err
+		}
+		s.sampler = append(allSampler{flagSampler}, chain...)
+	}
+
+	for i := range s.alternatives {
+		alternative := &s.alternatives[i]
+		if previous != nil {
+			for _, p := range previous.alternatives {
+				if p.URL == alternative.URL && p.SocketPath == alternative.SocketPath {
+					alternative.Transport, alternative.Breaker = p.Transport, p.Breaker
+				}
+			}
+		}
+		if alternative.SocketPath != "" && alternative.Transport == nil {
+			alternative.Transport = newUnixSocketTransport(alternative.SocketPath)
+		}
+		if *cbThreshold > 0 && alternative.Breaker == nil {
+			alternative.Breaker = newCircuitBreaker(*cbThreshold, time.Duration(*cbCooldownMs)*time.Millisecond)
+		}
+	}
+	return s, nil
+}
+
+// flags a reload takes from the config file again, unless they were given on the command line
+var reloadableFlags = []string{"b", "rc", "rt", "method-retries", "pct"}
+
+// re-reads the -config file and swaps in new settings, a file that can't be read or has invalid
+// settings keeps the current ones. Production targets and listeners need a restart
+func reloadConfig(path string) error {
+	if *serveAlt {
+		return errors.New("settings can't be reloaded with -serve-alt, restart instead")
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	// options left out of the file now fall back to their defaults, those given on the command line stay
+	values := configValues(config)
+	previous := make(map[string][]string)
+	restore := func() {
+		for name, value := range previous {
+			setOption(options.Lookup(name), value)
+		}
+	}
+	for _, name := range reloadableFlags {
+		if commandLineFlags[name] {
+			continue
+		}
+		f := options.Lookup(name)
+		previous[name] = []string{f.Value.String()}
+		value, ok := values[name]
+		if !ok {
+			value = defaultValues(f)
+		}
+		if err := setOption(f, value); err != nil {
+			restore()
+			return fmt.Errorf("invalid config value for -%s: %v", name, err)
+		}
+	}
+
+	s, err := newSettings(config, splitList(*altTarget), currentSettings.Load())
+	if err != nil {
+		restore()
+		return err
+	}
+	currentSettings.Store(s)
+	return nil
+}
@@ -0,0 +1,114 @@
+package tee
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	first, fromFirst := newRecordingBackend(t)
+	second, fromSecond := newRecordingBackend(t)
+	write := func(path, content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := writeConfig(t, fmt.Sprintf(`{"production": %q, "alternatives": [%q], "pct": 0}`, production.URL, first.URL))
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestProxy(t, config)
+
+	get(t, s.URL+"/before")
+	mirrors.Wait()
+	if len(fromFirst) != 0 {
+		t.Fatal("mirrored with pct 0")
+	}
+
+	write(path, fmt.Sprintf(`{"production": %q, "alternatives": [%q], "pct": 100}`, production.URL, first.URL))
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	get(t, s.URL+"/after")
+	mirrors.Wait()
+	if r := receive(t, fromFirst); r.URL.Path != "/after" {
+		t.Errorf("mirrored %s after reloading pct 100", r.URL.Path)
+	}
+
+	// alternatives are swapped as well
+	write(path, fmt.Sprintf(`{"production": %q, "alternatives": [%q], "pct": 100}`, production.URL, second.URL))
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	get(t, s.URL+"/swapped")
+	mirrors.Wait()
+	if r := receive(t, fromSecond); r.URL.Path != "/swapped" || len(fromFirst) != 0 {
+		t.Errorf("mirrored %s to the new alternative, %d to the old one", r.URL.Path, len(fromFirst))
+	}
+
+	// a file that doesn't parse or has invalid settings keeps the current ones
+	for _, content := range []string{`{"pct": `, fmt.Sprintf(`{"alternatives": [%q], "pct": 150}`, first.URL)} {
+		write(path, content)
+		if err := reloadConfig(path); err == nil {
+			t.Errorf("invalid config %s reloaded", content)
+		}
+		get(t, s.URL+"/kept")
+		mirrors.Wait()
+		if r := receive(t, fromSecond); r.URL.Path != "/kept" || *mirrorPercent != 100 {
+			t.Errorf("after a failed reload mirrored %s with pct %d", r.URL.Path, *mirrorPercent)
+		}
+	}
+}
+
+func TestRequestKeepsSettingsSnapshot(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives("http://localhost:9001"), Percent: ptr(100)})
+	r := withSettings(httptest.NewRequest("GET", "/", nil))
+
+	path := writeConfig(t, `{"alternatives": ["http://localhost:9002"], "pct": 10}`)
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	// the request started before the reload still sees all of the old settings, new ones get the new
+	if s := settingsOf(r); s.percent != 100 || s.alternatives[0].URL.Host != "localhost:9001" {
+		t.Errorf("request started before the reload got pct %d and %s", s.percent, s.alternatives[0].URL.Host)
+	}
+	if s := settingsOf(withSettings(httptest.NewRequest("GET", "/", nil))); s.percent != 10 || s.alternatives[0].URL.Host != "localhost:9002" {
+		t.Errorf("request started after the reload got pct %d and %s", s.percent, s.alternatives[0].URL.Host)
+	}
+}
+
+func TestReloadKeepsCommandLineFlags(t *testing.T) {
+	captureLog(t)
+	commandLineFlags = map[string]bool{"pct": true}
+	options.Set("pct", "30")
+	t.Cleanup(func() {
+		commandLineFlags = nil
+		applyConfig(nil)
+	})
+	newProxy(t, &Config{Alternatives: alternatives("http://localhost:9001")})
+
+	if err := reloadConfig(writeConfig(t, `{"alternatives": ["http://localhost:9001"], "pct": 80, "retry_count": 5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if *mirrorPercent != 30 || *retryCount != 5 {
+		t.Errorf("-pct %d -rc %d after reload, want the command line -pct and -rc from the file", *mirrorPercent, *retryCount)
+	}
+}
+
+func TestReloadRefusedWithServeAlt(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives("http://localhost:9001"), ServeAlt: ptr(true)})
+	if err := reloadConfig(writeConfig(t, `{}`)); err == nil || !strings.Contains(err.Error(), "-serve-alt") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package tee
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// sends every request dumped into path, as written by httputil.DumpRequest, to the alternatives like it just arrived,
+// then waits for all mirrors to finish. Requests go through teeDirector, so -pct and the other filters still apply
+func replay(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	count := 0
+	for {
+		// dumps are often separated by empty lines, which aren't part of any request
+		for {
+			b, err := reader.Peek(1)
+			if err != nil || (b[0] != '\r' && b[0] != '\n') {
+				break
+			}
+			reader.ReadByte()
+		}
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			mirrors.Wait()
+			return count, fmt.Errorf("could not read request %d from %s: %v", count+1, path, err)
+		}
+		count++
+
+		teeDirector(req)
+		// whatever mirrors didn't buffer has to be read too, before the next request can be parsed
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	mirrors.Wait()
+	return count, nil
+}
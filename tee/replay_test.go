@@ -0,0 +1,63 @@
+package tee
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+
+	path := filepath.Join(t.TempDir(), "requests.dump")
+	dumps := "GET /first?page=2 HTTP/1.1\r\nHost: shop.example.com\r\nX-Client: replay\r\n\r\n" +
+		"\r\n" +
+		"POST /second HTTP/1.1\r\nHost: shop.example.com\r\nContent-Type: application/json\r\nContent-Length: 10\r\n\r\n{\"id\": 42}\r\n"
+	if err := os.WriteFile(path, []byte(dumps), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := replay(path)
+	if err != nil || count != 2 {
+		t.Fatalf("replayed %d requests: %v", count, err)
+	}
+	// mirrors run concurrently, so they may arrive in either order
+	received := map[string]*http.Request{}
+	for i := 0; i < 2; i++ {
+		r := receive(t, fromAlternative)
+		received[r.URL.Path] = r
+	}
+	first, second := received["/first"], received["/second"]
+	if first == nil || second == nil {
+		t.Fatalf("alternative got %v", received)
+	}
+	if first.Method != "GET" || first.URL.String() != "/first?page=2" || first.Header.Get("X-Client") != "replay" {
+		t.Errorf("first replayed as %s %s %v", first.Method, first.URL, first.Header)
+	}
+	if body := bodyOf(second); second.Method != "POST" || second.URL.Path != "/second" || body != `{"id": 42}` {
+		t.Errorf("second replayed as %s %s with body %q", second.Method, second.URL.Path, body)
+	}
+	if len(fromProduction) != 0 {
+		t.Error("replayed request sent to production")
+	}
+}
+
+func TestReplayInvalidFile(t *testing.T) {
+	captureLog(t)
+	alternative, _ := newRecordingBackend(t)
+	newProxy(t, &Config{Alternatives: alternatives(alternative.URL)})
+
+	path := filepath.Join(t.TempDir(), "requests.dump")
+	os.WriteFile(path, []byte("GET /ok HTTP/1.1\r\nHost: a\r\n\r\nnot a request\r\n\r\n"), 0644)
+	if count, err := replay(path); err == nil || count != 1 || !strings.Contains(err.Error(), "could not read request 2") {
+		t.Errorf("replayed %d requests: %v", count, err)
+	}
+	if _, err := replay(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file replayed")
+	}
+}
@@ -0,0 +1,164 @@
+package tee
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Sampler decides whether a request is mirrored
+type Sampler interface {
+	ShouldMirror(*http.Request) bool
+}
+
+// SamplerFunc lets a plain function act as Sampler
+type SamplerFunc func(*http.Request) bool
+
+func (f SamplerFunc) ShouldMirror(r *http.Request) bool {
+	return f(r)
+}
+
+// allSampler mirrors when every sampler agrees, asking them in order and stopping at the first refusal,
+// so a rate sampler late in the chain only spends tokens on requests passing the ones before
+type allSampler []Sampler
+
+func (s allSampler) ShouldMirror(r *http.Request) bool {
+	for _, sampler := range s {
+		if !sampler.ShouldMirror(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// anySampler mirrors when at least one sampler agrees, asking them in order until one does
+type anySampler []Sampler
+
+func (s anySampler) ShouldMirror(r *http.Request) bool {
+	for _, sampler := range s {
+		if sampler.ShouldMirror(r) {
+			return true
+		}
+	}
+	return false
+}
+
+type percentSampler int
+
+func (s percentSampler) ShouldMirror(*http.Request) bool {
+	return rand.Intn(100) < int(s)
+}
+
+// exclude prefixes win over include ones, like with -include-paths and -exclude-paths
+type pathSampler struct {
+	include, exclude []string
+}
+
+func (s pathSampler) ShouldMirror(r *http.Request) bool {
+	return pathMatches(r.URL.Path, s.include, s.exclude)
+}
+
+// mirrors requests whose header value matches, without match expression any value does
+type headerSampler struct {
+	name  string
+	match *regexp.Regexp
+}
+
+func (s headerSampler) ShouldMirror(r *http.Request) bool {
+	values, ok := r.Header[http.CanonicalHeaderKey(s.name)]
+	if !ok {
+		return false
+	}
+	if s.match == nil {
+		return true
+	}
+	for _, v := range values {
+		if s.match.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type rateSampler struct {
+	bucket *tokenBucket
+}
+
+func (s rateSampler) ShouldMirror(*http.Request) bool {
+	return s.bucket.Allow(time.Now())
+}
+
+// the flag based rules, the -config sampling chain is appended to them. -mirror-rps is applied by teeDirector
+// afterwards to count and log limited requests
+var flagSampler = allSampler{
+	SamplerFunc(shouldMirror),
+	SamplerFunc(func(r *http.Request) bool { return mirrorPath(r.URL.Path) }),
+	SamplerFunc(func(r *http.Request) bool { return mirrorContentType(r.Header) }),
+}
+
+// SamplerConfig is one rule of the "sampling" chain in config file, Type picks which of the other fields apply
+type SamplerConfig struct {
+	Type    string          `json:"type"`
+	Percent int             `json:"pct"`
+	Include []string        `json:"include"`
+	Exclude []string        `json:"exclude"`
+	Header  string          `json:"header"`
+	Match   string          `json:"match"`
+	Rps     float64         `json:"rps"`
+	Burst   int             `json:"burst"`
+	Rules   []SamplerConfig `json:"rules"`
+}
+
+// rules of a chain all have to agree, "all" and "any" rules nest further chains
+func buildSampler(configs []SamplerConfig) (allSampler, error) {
+	chain := make(allSampler, 0, len(configs))
+	for i, c := range configs {
+		sampler, err := buildSamplerRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sampling rule %d: %v", i+1, err)
+		}
+		chain = append(chain, sampler)
+	}
+	return chain, nil
+}
+
+func buildSamplerRule(c SamplerConfig) (Sampler, error) {
+	switch c.Type {
+	case "percent":
+		if c.Percent < 0 || c.Percent > 100 {
+			return nil, fmt.Errorf("pct %d must be between 0 and 100", c.Percent)
+		}
+		return percentSampler(c.Percent), nil
+	case "path":
+		return pathSampler{include: c.Include, exclude: c.Exclude}, nil
+	case "header":
+		if c.Header == "" {
+			return nil, fmt.Errorf("header rule needs a header name")
+		}
+		s := headerSampler{name: c.Header}
+		if c.Match != "" {
+			re, err := regexp.Compile(c.Match)
+			if err != nil {
+				return nil, err
+			}
+			s.match = re
+		}
+		return s, nil
+	case "rate":
+		if c.Rps <= 0 {
+			return nil, fmt.Errorf("rate rule needs rps above 0")
+		}
+		return rateSampler{bucket: newTokenBucket(c.Rps, c.Burst)}, nil
+	case "all":
+		return buildSampler(c.Rules)
+	case "any":
+		rules, err := buildSampler(c.Rules)
+		if err != nil {
+			return nil, err
+		}
+		return anySampler(rules), nil
+	}
+	return nil, fmt.Errorf("unknown type %q, must be percent, path, header, rate, all or any", c.Type)
+}
@@ -0,0 +1,134 @@
+package tee
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSamplers(t *testing.T) {
+	request := func(path, header string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		if header != "" {
+			r.Header.Set("X-Tenant", header)
+		}
+		return r
+	}
+	always := SamplerFunc(func(*http.Request) bool { return true })
+	never := SamplerFunc(func(*http.Request) bool { return false })
+	for _, tc := range []struct {
+		name    string
+		sampler Sampler
+		r       *http.Request
+		want    bool
+	}{
+		{"percent 100", percentSampler(100), request("/", ""), true},
+		{"percent 0", percentSampler(0), request("/", ""), false},
+		{"path included", pathSampler{include: []string{"/api"}}, request("/api/users", ""), true},
+		{"path not included", pathSampler{include: []string{"/api"}}, request("/static/app.js", ""), false},
+		{"path excluded", pathSampler{include: []string{"/api"}, exclude: []string{"/api/admin"}}, request("/api/admin", ""), false},
+		{"header present", headerSampler{name: "x-tenant"}, request("/", "beta"), true},
+		{"header missing", headerSampler{name: "x-tenant"}, request("/", ""), false},
+		{"header matching", headerSampler{name: "X-Tenant", match: regexp.MustCompile("^beta-")}, request("/", "beta-1"), true},
+		{"header not matching", headerSampler{name: "X-Tenant", match: regexp.MustCompile("^beta-")}, request("/", "stable"), false},
+		{"rate within burst", rateSampler{bucket: newTokenBucket(1, 1)}, request("/", ""), true},
+		{"all agreeing", allSampler{always, always}, request("/", ""), true},
+		{"all with a refusal", allSampler{always, never}, request("/", ""), false},
+		{"all empty", allSampler{}, request("/", ""), true},
+		{"any with an agreement", anySampler{never, always}, request("/", ""), true},
+		{"any refusing", anySampler{never, never}, request("/", ""), false},
+		{"any empty", anySampler{}, request("/", ""), false},
+	} {
+		if got := tc.sampler.ShouldMirror(tc.r); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRateSamplerRefusesPastBurst(t *testing.T) {
+	s := rateSampler{bucket: newTokenBucket(0.001, 2)}
+	r := httptest.NewRequest("GET", "/", nil)
+	if !s.ShouldMirror(r) || !s.ShouldMirror(r) || s.ShouldMirror(r) {
+		t.Error("rate sampler didn't stop after its burst of 2")
+	}
+}
+
+func TestAllSamplerStopsAtFirstRefusal(t *testing.T) {
+	var asked int32
+	counting := SamplerFunc(func(*http.Request) bool { atomic.AddInt32(&asked, 1); return true })
+	s := allSampler{SamplerFunc(func(*http.Request) bool { return false }), counting}
+	if s.ShouldMirror(httptest.NewRequest("GET", "/", nil)) || atomic.LoadInt32(&asked) != 0 {
+		t.Errorf("samplers after a refusal were asked %d times", asked)
+	}
+}
+
+func TestBuildSampler(t *testing.T) {
+	// mirrors /api requests of the beta tenant, or any request with X-Debug
+	chain, err := buildSampler([]SamplerConfig{
+		{Type: "any", Rules: []SamplerConfig{
+			{Type: "all", Rules: []SamplerConfig{
+				{Type: "path", Include: []string{"/api"}},
+				{Type: "header", Header: "X-Tenant", Match: "^beta$"},
+			}},
+			{Type: "header", Header: "X-Debug"},
+		}},
+		{Type: "percent", Percent: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path    string
+		headers map[string]string
+		want    bool
+	}{
+		{"/api/users", map[string]string{"X-Tenant": "beta"}, true},
+		{"/api/users", map[string]string{"X-Tenant": "stable"}, false},
+		{"/static", map[string]string{"X-Tenant": "beta"}, false},
+		{"/static", map[string]string{"X-Debug": "1"}, true},
+		{"/api/users", nil, false},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		if got := chain.ShouldMirror(r); got != tc.want {
+			t.Errorf("%s with %v: got %v, want %v", tc.path, tc.headers, got, tc.want)
+		}
+	}
+}
+
+func TestInvalidSamplingRules(t *testing.T) {
+	for _, tc := range []struct {
+		rule SamplerConfig
+		err  string
+	}{
+		{SamplerConfig{Type: "percent", Percent: 101}, "between 0 and 100"},
+		{SamplerConfig{Type: "header"}, "needs a header name"},
+		{SamplerConfig{Type: "header", Header: "X-Tenant", Match: "("}, "missing closing )"},
+		{SamplerConfig{Type: "rate"}, "rps above 0"},
+		{SamplerConfig{Type: "any", Rules: []SamplerConfig{{Type: "random"}}}, `unknown type "random"`},
+	} {
+		if _, err := buildSampler([]SamplerConfig{tc.rule}); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%+v: error %v, want one about %s", tc.rule, err, tc.err)
+		}
+	}
+}
+
+func TestSamplingChainFromConfig(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL),
+		Sampling: []SamplerConfig{{Type: "path", Include: []string{"/api"}}}})
+
+	get(t, s.URL+"/static")
+	get(t, s.URL+"/api/users")
+	mirrors.Wait()
+	if r := receive(t, fromAlternative); r.URL.Path != "/api/users" || len(fromAlternative) != 0 {
+		t.Errorf("mirrored %s and %d more, want only /api/users", r.URL.Path, len(fromAlternative))
+	}
+}
@@ -0,0 +1,2071 @@
+package tee
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// every option is registered with a flag set of the package instead of flag.CommandLine, so importing it adds no flags
+// to a program. Main parses the command line into the same values, everything else sets them through a Config
+var options = flag.NewFlagSet("teeproxy", flag.ContinueOnError)
+
+var (
+	listen           = options.String("l", ":8888", "port to accept requests, comma separated for several, http:// or https:// in front picks the protocol per port")
+	targetProduction = options.String("a", "http://localhost:8080", "where production traffic goes. http://localhost:8080/production, followed by comma separated fallback targets")
+	altTarget        = options.String("b", "http://localhost:8081", "where testing traffic goes, comma separated for several targets. response are skipped. http://localhost:8081/test,unix:///var/run/test.sock")
+	retryCount       = options.Int("rc", 3, "how many times a mirror is attempted on alternative destination server errors, 0 and 1 both send it once")
+	retryTimeoutMs   = options.Int("rt", 250, "timeout in milliseconds between retries on alternative destination server errors")
+	connectTimeoutMs = options.Int("ct", 1000, "timeout in milliseconds for connecting to destination servers")
+	headerTimeoutMs  = options.Int("ht", 10000, "timeout in milliseconds for waiting on response headers from destination servers")
+	prodTimeoutMs    = options.Int("prod-timeout", 0, "timeout in milliseconds for the whole production exchange including the response body, unlimited when 0")
+	mirrorPercent    = options.Int("pct", 100, "percentage (0-100) of requests mirrored to alternative destination server")
+	headerSampling   = options.Bool("header-sampling", false, "let a X-Shadow-Sample request header (0-100) set the mirrored percentage of that request instead of -pct")
+	logFormat        = options.String("logformat", "text", "log output format, text or json")
+	logFile          = options.String("logfile", "", "file log entries are appended to instead of written to stdout")
+	logTruncate      = options.Bool("logfile-truncate", false, "empty -logfile on start instead of appending to it")
+	logLevel         = options.String("loglevel", "info", "lowest level of messages logged, debug, info, warn or error")
+	metricsListen    = options.String("metrics", "", "port to serve Prometheus metrics on /metrics, disabled when empty")
+	includePathsList = options.String("include-paths", "", "comma separated path prefixes to mirror, all paths are mirrored when empty")
+	excludePathsList = options.String("exclude-paths", "", "comma separated path prefixes never mirrored, wins over -include-paths")
+	contentTypeList  = options.String("mirror-content-types", "", "comma separated media types mirrored, like application/json or text/*, all are mirrored when empty")
+	shutdownTimeout  = options.Int("shutdown-timeout", 5000, "grace period in milliseconds for in-flight requests and mirrors on shutdown")
+	maxMirrorBody    = options.Int64("max-mirror-body", 0, "requests with bodies larger than this many bytes are proxied to production but not mirrored, unlimited when 0")
+	maxBody          = options.Int64("max-body", 0, "maximum request body bytes buffered for mirrors, unlimited when 0")
+	spillThreshold   = options.Int64("spill-threshold", 0, "request bodies larger than this many bytes are buffered in a temp file instead of memory, never when 0")
+	streamBuffer     = options.Int("stream-buffer", 0, "stream request bodies to a single mirror through a buffer of this many bytes instead of buffering them whole, off when 0")
+	maxBodyPolicy    = options.String("max-body-policy", "truncate", "what to do with mirrors of bodies over -max-body, truncate or skip")
+	compare          = options.Bool("compare", false, "compare alternative responses against production and log differences")
+	comparePercent   = options.Int("compare-pct", 100, "percentage (0-100) of requests whose responses are compared with -compare")
+	goldenFile       = options.String("golden-file", "", "JSON file of expected responses by method and path, alternative responses are compared with them instead of production")
+	compareMaxBody   = options.Int("compare-max-body", 65536, "maximum response body bytes compared")
+	latencyFactor    = options.Float64("latency-regression-factor", 0, "with -compare warn when the alternative takes more than this many times as long as production, never when 0")
+	compareHeaders   = options.Bool("compare-headers", false, "with -compare also report response headers added, removed or changed by alternatives")
+	ignoreHeaderList = options.String("compare-ignore-headers", "Date,X-Request-Id", "comma separated response headers left out by -compare-headers")
+	retryStatusList  = options.String("retry-statuses", "501-599", "comma separated status codes and ranges of alternative responses that are retried, e.g. 429,500-599")
+	maxRetryWaitMs   = options.Int("max-retry-wait", 10000, "maximum milliseconds honored from Retry-After header of alternative destination server errors")
+	backoff          = options.String("backoff", "constant", "wait between retries, constant or exponential doubling -rt each retry")
+	backoffMaxMs     = options.Int("backoff-max", 10000, "ceiling in milliseconds for exponential backoff")
+	backoffJitter    = options.Bool("backoff-jitter", false, "randomize exponential backoff between half and full wait")
+	retryJitter      = options.Float64("retry-jitter", 0, "fraction between 0 and 1 every wait between retries is randomly lengthened or shortened by")
+	mirrorGzip       = options.Bool("mirror-gzip", false, "gzip request bodies sent to alternatives and set Content-Encoding: gzip, to save bandwidth to remote test systems")
+	transformCmd     = options.String("transform-cmd", "", "shell command mirrored request bodies are piped through, its output is sent to alternatives instead")
+	assertCmd        = options.String("assert-cmd", "", "shell command each alternative response body is piped to, a non-zero exit counts as failed assertion")
+	grpcMode         = options.Bool("grpc", false, "proxy and mirror gRPC: HTTP/2 to production and alternatives, h2c accepted from clients on plain listeners")
+	h2c              = options.Bool("h2c", false, "use HTTP/2 to production, without TLS the production server has to support h2c")
+	healthPath       = options.String("health-path", "/healthz", "path answered by the proxy itself for health checks, never forwarded nor mirrored")
+	dedupHeader      = options.String("dedup-header", "", "request header like Idempotency-Key, requests repeating a recently seen value are not mirrored again")
+	dedupTTLMs       = options.Int("dedup-ttl", 60000, "milliseconds a -dedup-header value is remembered")
+	dedupSize        = options.Int("dedup-size", 10000, "maximum number of -dedup-header values remembered")
+	statsInterval    = options.Int("stats-interval", 0, "milliseconds between log lines with alternative latency percentiles, never when 0")
+	basePath         = options.String("base-path", "", "path prefix requests are served under, removed before forwarding, others get 404")
+	versionPath      = options.String("version-path", "/version", "path answered by the proxy itself with its version as JSON, never forwarded nor mirrored, disabled when empty")
+	statsPath        = options.String("stats-path", "", "path answered by the proxy itself with runtime counters as JSON, never forwarded nor mirrored")
+	healthProbe      = options.Bool("health-probe", false, "health check also probes production destination, reporting 503 when it's unreachable")
+	certFile         = options.String("cert", "", "TLS certificate file, listens with HTTPS when set together with -key")
+	keyFile          = options.String("key", "", "TLS private key file")
+	tlsMin           = options.String("tls-min", "1.2", "minimum TLS version accepted by HTTPS listener, 1.0, 1.1, 1.2 or 1.3")
+	clientCAFile     = options.String("client-ca", "", "CA certificates file client certificates are verified against by HTTPS listener")
+	tlsClientHeaders = options.Bool("tls-client-headers", false, "pass client certificate CN and verification result in X-SSL-Client-CN and X-SSL-Client-Verify to destination servers")
+	altInsecure      = options.Bool("alt-insecure", false, "skip TLS certificate verification for alternative destinations only")
+	mirrorRps        = options.Float64("mirror-rps", 0, "maximum requests per second mirrored to alternative destinations, unlimited when 0")
+	mirrorBurst      = options.Int("mirror-burst", 1, "requests mirrored in a burst above -mirror-rps")
+	mirrorMethod     = options.String("mirror-method", "", "method used for mirrored requests instead of the original one, e.g. GET to avoid side effects")
+	altMaxIdleConns  = options.Int("alt-max-idle-conns", 100, "maximum idle connections kept open to alternative destinations, unlimited when 0")
+	altIdlePerHost   = options.Int("alt-max-idle-conns-per-host", 100, "maximum idle connections kept open to each alternative destination")
+	altIdleTimeoutMs = options.Int("alt-idle-timeout", 90000, "milliseconds an idle connection to alternative destinations is kept open, forever when 0")
+	dryRun           = options.Bool("dry-run", false, "log mirrored requests that would be sent to alternative destinations without sending them")
+	cbThreshold      = options.Int("cb-threshold", 0, "consecutive mirror failures opening circuit breaker of an alternative destination, disabled when 0")
+	cbCooldownMs     = options.Int("cb-cooldown", 30000, "milliseconds mirroring stays paused once circuit breaker opened, before probing again")
+	stickyKey        = options.String("mirror-sticky-key", "", "send each request to one alternative destination picked by hashing ip or header:Name, to all when empty")
+	altRewrite       = options.String("alt-rewrite", "", "regexp rewrite of request path for alternative destinations, as pattern=>replacement, e.g. ^/api/(.*)=>/v2/$1")
+	mirrorUA         = options.String("mirror-ua", "", "User-Agent header sent to alternative destinations instead of the client's")
+	mirrorUASuffix   = options.String("mirror-ua-suffix", "", "appended to the User-Agent header sent to alternative destinations, e.g. teeproxy-shadow")
+	altHost          = options.String("alt-host", "", "Host header sent to alternative destinations, the alternative URL host when empty")
+	accessLog        = options.Bool("access-log", false, "log method, path, status, bytes and duration of every production response")
+	hashBody         = options.Bool("hash-body", false, "log a SHA-256 prefix of request bodies for production and every mirror, to correlate them without logging content")
+	dumpRequests     = options.Bool("dump-requests", false, "log full incoming requests including bodies, only method and path otherwise")
+	dumpResponses    = options.Bool("dump-responses", false, "log full alternative responses including bodies")
+	maxHeaderBytes   = options.Int("max-header-bytes", 0, "maximum bytes of request headers, larger ones are answered with 431 instead of being proxied and mirrored, http.DefaultMaxHeaderBytes when 0")
+	maxDumpBody      = options.Int("max-dump-body", 4096, "maximum response body bytes dumped by -dump-responses, unlimited when 0")
+	workers          = options.Int("workers", 0, "number of workers sending mirrors from a bounded queue, one goroutine per mirror when 0")
+	queueSize        = options.Int("queue-size", 1000, "mirrors waiting for a worker before -drop-policy applies")
+	queueWarn        = options.Int("queue-warn-threshold", 0, "log a warning when more than this many mirrors wait in the -workers queue, never when 0")
+	dropPolicy       = options.String("drop-policy", "newest", "mirror dropped when queue is full, newest or oldest")
+	stripExpect      = options.Bool("strip-expect", true, "remove Expect: 100-continue from mirrored requests, as their body is at hand already")
+	forwardedHeaders = options.Bool("forwarded-headers", true, "set X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host on requests to destination servers")
+	methodRetryList  = options.String("method-retries", "", "comma separated METHOD=count overriding -rc per method, e.g. GET=3,POST=1, other methods than GET, HEAD, OPTIONS, TRACE, PUT and DELETE aren't retried otherwise")
+	retryOnError     = options.Bool("retry-on-error", false, "also retry mirrors failing with connection errors or timeouts, not just those answered with a -retry-status")
+	retryBudgetMs    = options.Int("retry-budget", 0, "milliseconds after the first attempt of a mirror no further retry is started, unlimited when 0")
+	mirrorTimeoutMs  = options.Int("mirror-timeout", 0, "maximum total milliseconds a mirror may take including all retries, unlimited when 0")
+	otelEndpoint     = options.String("otel-endpoint", "", "OTLP/HTTP collector URL spans of requests, production requests and mirrors are exported to, e.g. http://localhost:4318, none when empty")
+	allowConnect     = options.Bool("allow-connect", false, "tunnel CONNECT requests to production instead of answering them with 405, tunnels are never mirrored")
+	targetHeader     = options.String("target-header", "", "request header naming one of the config file production_targets a request is proxied to, e.g. X-Target")
+	serveAlt         = options.Bool("serve-alt", false, "answer clients with the response of the first alternative and mirror requests to production instead")
+	mirrorOnly       = options.Bool("mirror-only", false, "don't proxy to production, answer clients with -mirror-only-status and only send requests to alternatives")
+	mirrorOnlyStatus = options.Int("mirror-only-status", http.StatusAccepted, "status code returned to clients with -mirror-only")
+	allowCIDRs       = options.String("allow-cidr", "", "comma separated networks clients must connect from, all when empty")
+	denyCIDRs        = options.String("deny-cidr", "", "comma separated networks whose clients are refused, even if allowed by -allow-cidr")
+	basicAuth        = options.String("basic-auth", "", "user:pass clients need to send as HTTP Basic credentials, no authentication when empty")
+	harOut           = options.String("har-out", "", "HAR file compared production and alternative exchanges are written to on shutdown, with -compare")
+	harMaxEntries    = options.Int("har-max-entries", 1000, "most compared requests kept for -har-out, later ones are dropped and counted, unlimited when 0")
+	recordFile       = options.String("record", "", "file mirrored requests are appended to, in the format read by -replay")
+	replayFile       = options.String("replay", "", "file of raw HTTP requests to send to alternatives instead of serving, exits once all are mirrored")
+	preflightCheck   = options.Bool("preflight", false, "send a HEAD request to every destination on startup and log whether it's reachable")
+	preflightAbort   = options.String("preflight-abort", "production", "comma separated destinations whose failed preflight aborts startup: production, alternatives")
+
+	// Hop-by-hop headers. These are removed when sent to the backend.
+	// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+	hopHeaders = []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Te", // canonicalized version of "TE"
+		"Trailers",
+		"Transfer-Encoding",
+		"Upgrade",
+	}
+)
+
+// Hosts are the production targets, alternatives are part of the settings a reload swaps
+type Hosts struct {
+	Target    url.URL
+	Fallbacks []url.URL
+}
+
+// Alternative is a destination requests are mirrored to, with its own retry policy
+// a unix:///path/to.sock target has SocketPath set and its own Transport dialing the socket
+// Breaker is nil unless -cb-threshold is set
+type Alternative struct {
+	URL            url.URL
+	RetryCount     int
+	RetryTimeoutMs int
+	SocketPath     string
+	Transport      http.RoundTripper
+	Breaker        *circuitBreaker
+	Weight         int
+}
+
+var hosts Hosts
+var namedTargets map[string]url.URL
+var includePaths, excludePaths []string
+var mirrorContentTypes []string
+var ignoredHeaders map[string]bool
+var mirrorLimiter *tokenBucket
+var retryStatuses statusMatcher
+var pathRewrite *regexp.Regexp
+var pathReplacement string
+var addHeaders, stripHeaders, hostMapList listFlag
+var hostMap map[string]string
+var mirrorHeaders http.Header
+var proxy *httputil.ReverseProxy
+
+// idGenerator hands out the ids correlating log entries of a request and its mirrors
+type idGenerator interface {
+	NewId() string
+}
+
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewId() string {
+	return uuid.New().String()
+}
+
+var ids idGenerator = uuidGenerator{}
+var altTransport http.RoundTripper = http.DefaultTransport
+
+// tracks mirrors from being enqueued until clientCall finished, so replays and tests can wait for them,
+// mirrorsPending counts the same mirrors for shutdown, which can't Wait as it gives up on them at its deadline.
+// mirrorsDrained gets a value whenever mirrorsPending drops to 0, shutdown checks the count again on it
+var mirrors sync.WaitGroup
+var mirrorsPending int64
+var mirrorsDrained = make(chan struct{}, 1)
+
+func mirrorStarted() {
+	atomic.AddInt64(&mirrorsPending, 1)
+	mirrors.Add(1)
+}
+
+func mirrorFinished() {
+	if atomic.AddInt64(&mirrorsPending, -1) == 0 {
+		select {
+		case mirrorsDrained <- struct{}{}:
+		default:
+		}
+	}
+	mirrors.Done()
+}
+
+func init() {
+	options.Var(&addHeaders, "add-header", "header set on mirrored requests only, as \"Name: Value\", can be repeated")
+	options.Var(&stripHeaders, "strip-header", "header removed from mirrored requests only, e.g. Authorization, can be repeated")
+	options.Var(&hostMapList, "host-map", "address mirrors connect to for a host name instead of resolving it, as hostname=ip:port, can be repeated")
+}
+
+// listFlag collects values of a flag given several times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// TimeoutTransport bounds the time spent connecting to a destination server and
+// waiting for its response headers, so a hung backend can't block a request forever.
+type TimeoutTransport struct {
+	http.Transport
+	ConnectTimeout time.Duration
+	// set by enableHTTP2, http requests then go to a copy of the embedded transport speaking h2c
+	http2   bool
+	h2cOnce sync.Once
+	h2c     *http.Transport
+}
+
+func NewTimeoutTransport(connectTimeout, responseHeaderTimeout time.Duration) *TimeoutTransport {
+	t := &TimeoutTransport{ConnectTimeout: connectTimeout}
+	t.Transport.Proxy = http.ProxyFromEnvironment
+	t.Transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.Transport.TLSHandshakeTimeout = connectTimeout
+	// starts once the request body has been sent, so slow uploads aren't cut off
+	t.ResponseHeaderTimeout = responseHeaderTimeout
+	return t
+}
+
+// https destinations negotiate HTTP/2 with ALPN, cleartext ones are spoken to in HTTP/2 right away (prior knowledge),
+// so they have to support h2c. Connections are dialed by DialContext, so host mapping and unix sockets still apply
+func (t *TimeoutTransport) enableHTTP2() {
+	// custom dialer turns off the automatic HTTP/2 support of http.Transport
+	t.ForceAttemptHTTP2 = true
+	t.http2 = true
+}
+
+// a timeout connecting or waiting for the response headers is reported as context.DeadlineExceeded
+func (t *TimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := &t.Transport
+	if t.http2 && req.URL.Scheme == "http" {
+		// copied on first use, once connection settings are all in place
+		t.h2cOnce.Do(func() {
+			t.h2c = t.Transport.Clone()
+			t.h2c.Protocols = new(http.Protocols)
+			t.h2c.Protocols.SetUnencryptedHTTP2(true)
+		})
+		transport = t.h2c
+	}
+
+	resp, err := transport.RoundTrip(req)
+	// deadlines of the request context itself are left to the caller
+	var netErr net.Error
+	if err != nil && req.Context().Err() == nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, fmt.Errorf("timed out waiting for response from %s: %w: %w", req.URL.Host, err, context.DeadlineExceeded)
+	}
+	return resp, err
+}
+
+func newMirrorTransport() *TimeoutTransport {
+	t := NewTimeoutTransport(time.Duration(*connectTimeoutMs)*time.Millisecond, time.Duration(*headerTimeoutMs)*time.Millisecond)
+	if len(hostMap) > 0 {
+		dial := t.DialContext
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, network, mapHost(addr))
+		}
+	}
+	if *grpcMode {
+		t.enableHTTP2()
+	}
+	t.MaxIdleConns = *altMaxIdleConns
+	t.MaxIdleConnsPerHost = *altIdlePerHost
+	t.IdleConnTimeout = time.Duration(*altIdleTimeoutMs) * time.Millisecond
+	if *altInsecure {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return t
+}
+
+// mirror transport connecting to the unix domain socket at path whatever host requests are for
+func newUnixSocketTransport(path string) *TimeoutTransport {
+	t := newMirrorTransport()
+	dialer := &net.Dialer{Timeout: t.ConnectTimeout}
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	return t
+}
+
+func clientCall(id string, target *Alternative, req2 *http.Request, body *requestBody, c *comparison) {
+	atomic.AddInt64(&mirrorsInFlight, 1)
+	defer atomic.AddInt64(&mirrorsInFlight, -1)
+	defer mirrorFinished()
+	defer body.release()
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&mirrorPanicsTotal, 1)
+			logMessage(id, "ERROR", fmt.Sprintf("Recovered in clientCall: <%v> <%s>", r, string(debug.Stack())))
+		}
+	}()
+
+	if *dryRun {
+		logMessage(id, "INFO", fmt.Sprintf("Dry run, would send: <%s %s> headers <%v> body <%d bytes>", req2.Method, req2.URL, req2.Header, body.Len()))
+		return
+	}
+
+	s := settingsOf(req2)
+	// mirrors never share the client request context, so a client going away doesn't cancel them,
+	// -mirror-timeout bounds all attempts of a mirror together instead. Only the span is taken along
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(req2.Context()))
+	if *mirrorTimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*mirrorTimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	ctx, span := startMirrorSpan(ctx, id, req2)
+	defer span.End()
+	req2 = req2.WithContext(ctx)
+
+	// -transform-cmd output replaces the body of this mirror, production keeps the original one
+	var transformed []byte
+	if *transformCmd != "" && req2.ContentLength != 0 {
+		var err error
+		transformed, err = transformBody(ctx, *transformCmd, body.Reader())
+		if err != nil {
+			target.Breaker.Abort()
+			setSpanResult(span, 0, err)
+			logMessage(id, "ERROR", fmt.Sprintf("Could not transform body, not mirroring: <%v>", err))
+			return
+		}
+		if req2.ContentLength > 0 {
+			req2.ContentLength = int64(len(transformed))
+		}
+	}
+
+	// breaker only learns about mirrors that got through retries, a panic counts as failure too
+	succeeded := false
+	defer func() {
+		if succeeded {
+			if target.Breaker.Success() {
+				logMessage(id, "INFO", fmt.Sprintf("Circuit breaker closed for %s", target.URL.Host))
+			}
+		} else if target.Breaker.Failure(time.Now()) {
+			logMessage(id, "WARN", fmt.Sprintf("Circuit breaker opened for %s, mirroring paused for %dms", target.URL.Host, *cbCooldownMs))
+		}
+	}()
+
+	// one concise line per mirror, whatever way it ended, status stays 0 when no response was received
+	status, retries, started := 0, 0, time.Now()
+	// with -hash-body the hash of what the mirror sent matches the one production's request was logged with, unless it got truncated or transformed
+	hash := body.hash
+	if transformed != nil && hash != "" {
+		hash = bodyHash(bytes.NewReader(transformed))
+	}
+	defer func() {
+		var err error
+		if !succeeded {
+			err = fmt.Errorf("mirror failed after %d retries", retries)
+		}
+		setSpanResult(span, status, err)
+		if hash != "" {
+			logMessage(id, "INFO", fmt.Sprintf("Mirror summary: status <%d> retries <%d> latency <%v> body sha256 <%s>", status, retries, time.Since(started), hash))
+			return
+		}
+		logMessage(id, "INFO", fmt.Sprintf("Mirror summary: status <%d> retries <%d> latency <%v>", status, retries, time.Since(started)))
+	}()
+
+	// last response received is compared to production and asserted, whether retries succeeded or not
+	var altResponse *capturedResponse
+	if c != nil {
+		defer func() {
+			if altResponse != nil {
+				c.compare(id, altResponse)
+			}
+		}()
+	}
+	if assertResponse != nil {
+		defer func() {
+			if altResponse != nil {
+				checkAssertion(ctx, id, altResponse)
+			}
+		}()
+	}
+
+	// -mirror-gzip compresses the body once for all attempts, after -transform-cmd and the hash were done with it,
+	// a body the client sent encoded already is left as it is and gRPC compresses messages in a way of its own
+	if *mirrorGzip && req2.ContentLength != 0 && req2.Header.Get("Content-Encoding") == "" && !isGRPC(req2.Header) {
+		src := body.Reader()
+		if transformed != nil {
+			src = bytes.NewReader(transformed)
+		}
+		if compressed, err := gzipBody(src); err != nil {
+			logMessage(id, "WARN", fmt.Sprintf("Could not compress body, mirroring it uncompressed: <%v>", err))
+		} else {
+			transformed = compressed
+			req2.Header.Set("Content-Encoding", "gzip")
+			if req2.ContentLength > 0 {
+				req2.ContentLength = int64(len(compressed))
+			}
+		}
+	}
+
+	attempts := s.retryAttempts(target, req2.Method)
+	// waits before the attempt after retry, false when the retry budget doesn't allow another one or -mirror-timeout passed meanwhile,
+	// lastErr then tells why the mirror failed unless it was a retried response
+	var lastErr error
+	nextAttempt := func(retry int, header http.Header, reason string) bool {
+		delay := retryDelay(header, time.Now(), time.Duration(target.RetryTimeoutMs)*time.Millisecond, retry)
+		// attempts already under way are never cut short, the budget just decides whether another one starts
+		if *retryBudgetMs > 0 && time.Since(started)+delay > time.Duration(*retryBudgetMs)*time.Millisecond {
+			logMessage(id, "WARN", fmt.Sprintf("%s. Retry budget of %dms exhausted after %d retries", reason, *retryBudgetMs, retries))
+			return false
+		}
+
+		atomic.AddInt64(&mirrorRetriesTotal, 1)
+		retries++
+		logMessage(id, "WARN", fmt.Sprintf("%s. Retrying request %v/%v", reason, retry+2, attempts))
+		select {
+		case <-time.After(delay):
+			return true
+		case <-ctx.Done():
+			lastErr = fmt.Errorf("mirror timed out after %dms waiting to retry: %w", *mirrorTimeoutMs, ctx.Err())
+			return false
+		}
+	}
+
+	for retry := 0; retry < attempts; retry++ {
+		// once request is send, the body is read and is empty for second try, need to recreate body reader each time request is made
+		if req2.ContentLength == 0 {
+			req2.Body = http.NoBody
+		} else if transformed != nil {
+			req2.Body = ioutil.NopCloser(bytes.NewReader(transformed))
+		} else {
+			req2.Body = ioutil.NopCloser(body.Reader())
+		}
+
+		start := time.Now()
+		transport := altTransport
+		if target.Transport != nil {
+			transport = target.Transport
+		}
+		resp, err := transport.RoundTrip(req2)
+		if err != nil {
+			class := failureClass(err)
+			// with -retry-on-error a backend that is down or too slow gets further attempts like one answering 503
+			if *retryOnError && retry+1 != attempts && (class == failureConnection || class == failureTimeout) {
+				lastErr = err
+				if !nextAttempt(retry, nil, fmt.Sprintf("Invoking client failed (%s): <%v>", failureClasses[class], err)) {
+					break
+				}
+				continue
+			}
+			countFailure(class)
+			logMessage(id, "ERROR", fmt.Sprintf("Invoking client failed (%s): <%v>. Request: <%s>.", failureClasses[class], err, prettyPrint(req2)))
+			return
+		}
+		lastErr = nil
+
+		status = resp.StatusCode
+
+		// body is dumped while being drained below, so at most -max-dump-body of it is held for logging
+		var dump []byte
+		var dumpBody *cappedBuffer
+		if *dumpResponses {
+			r, e := httputil.DumpResponse(resp, false)
+			if e != nil {
+				logMessage(id, "ERROR", fmt.Sprintf("Could not create response dump: <%v>", e))
+			} else {
+				dump = r
+				dumpBody = &cappedBuffer{limit: *maxDumpBody}
+				if *maxDumpBody <= 0 {
+					dumpBody.limit = math.MaxInt32
+				}
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(resp.Body, dumpBody), resp.Body}
+			}
+		}
+
+		var read int64
+		if c != nil || assertResponse != nil {
+			captured := &cappedBuffer{limit: *compareMaxBody}
+			read, _ = io.Copy(captured, resp.Body)
+			altResponse = &capturedResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: captured.Bytes(), Started: start, Duration: time.Since(start)}
+			if har != nil {
+				requestBody, _ := ioutil.ReadAll(io.LimitReader(body.Reader(), int64(*compareMaxBody)))
+				altResponse.Request, altResponse.RequestBody = req2, requestBody
+			}
+		} else {
+			read, _ = io.Copy(ioutil.Discard, resp.Body)
+		}
+
+		if dumpBody != nil {
+			// the marker goes past the limit, written to the capped buffer it would be dropped
+			if truncated := read - int64(dumpBody.Len()); truncated > 0 {
+				fmt.Fprintf(&dumpBody.Buffer, "...[truncated %d bytes]", truncated)
+			}
+			logMessage(id, "INFO", fmt.Sprintf("Response: <%s%s>", dump, dumpBody.Bytes()))
+		}
+		resp.Body.Close()
+		alternativeLatency.Observe(time.Since(start).Seconds())
+		latencySample.Observe(time.Since(start).Seconds())
+
+		// By default want to retry server errors like gateway time-out, bad gateway, service unavailable etc.
+		// We specifically don't want to retry 500 as that means request reached the server, it still failed the mirror
+		if !retryStatuses.Match(resp.StatusCode) {
+			if resp.StatusCode < 500 {
+				succeeded = true
+				return
+			}
+			break
+		}
+
+		if retry+1 != attempts && !nextAttempt(retry, resp.Header, fmt.Sprintf("Received %d response", resp.StatusCode)) {
+			break
+		}
+	}
+
+	switch {
+	case lastErr != nil:
+		countFailure(failureClass(lastErr))
+		logMessage(id, "ERROR", fmt.Sprintf("Request failed: <%v>", lastErr))
+	case status >= 500:
+		countFailure(failureServerError)
+		logMessage(id, "ERROR", fmt.Sprintf("Request failed with status %d", status))
+	default:
+		countFailure(failureOther)
+		logMessage(id, "ERROR", fmt.Sprintf("Request failed with status %d", status))
+	}
+}
+
+// methods a repeated request has the same effect for, anything else is only retried when -method-retries says so
+var idempotentMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true, "PUT": true, "DELETE": true}
+
+// attempts a mirror with method gets, counted like -rc: -method-retries wins over the retry count of target,
+// which non-idempotent methods like POST don't get. Every mirror is sent at least once, so 0 means no retries like 1
+func (s *settings) retryAttempts(target *Alternative, method string) int {
+	attempts := target.RetryCount
+	if n, ok := s.methodRetries[method]; ok {
+		attempts = n
+	} else if !idempotentMethods[method] {
+		attempts = 1
+	}
+	if attempts < 1 {
+		return 1
+	}
+	return attempts
+}
+
+// -method-retries is a comma separated list of METHOD=count
+func parseMethodRetries(list string) (map[string]int, error) {
+	retries := make(map[string]int)
+	for _, entry := range splitList(list) {
+		i := strings.Index(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if i <= 0 || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid -method-retries value %q, must be METHOD=count", entry)
+		}
+		retries[strings.ToUpper(strings.TrimSpace(entry[:i]))] = n
+	}
+	return retries, nil
+}
+
+// wait before retrying, Retry-After header given either as seconds or HTTP date is honored up to -max-retry-wait, otherwise backoff is used
+func retryDelay(header http.Header, now time.Time, base time.Duration, retry int) time.Duration {
+	retryAfter := header.Get("Retry-After")
+	if retryAfter == "" {
+		return backoffDelay(base, retry)
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		delay = date.Sub(now)
+	} else {
+		return backoffDelay(base, retry)
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+	if max := time.Duration(*maxRetryWaitMs) * time.Millisecond; delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// base wait for constant backoff, exponential one doubles it for every retry already made up to -backoff-max
+func backoffDelay(base time.Duration, retry int) time.Duration {
+	delay := base
+	if *backoff == "exponential" {
+		max := time.Duration(*backoffMaxMs) * time.Millisecond
+		for i := 0; i < retry && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+		if *backoffJitter && delay > 0 {
+			delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		}
+	}
+
+	// spreads retries of mirrors that failed together, so they don't all hit a recovering alternative at once
+	if *retryJitter > 0 && delay > 0 {
+		delay += time.Duration(float64(delay) * *retryJitter * (2*rand.Float64() - 1))
+	}
+	return delay
+}
+
+func teeDirector(req *http.Request) {
+	id := requestId(req)
+	atomic.AddInt64(&requestsTotal, 1)
+
+	if *dumpRequests {
+		r, e := httputil.DumpRequest(req, true)
+		if e != nil {
+			logMessage(id, "ERROR", fmt.Sprintf("Could not create request dump: <%v>", e))
+			r = []byte{}
+		}
+
+		logMessage(id, "INFO", fmt.Sprintf("Request: <%s>", r))
+	} else {
+		logMessage(id, "INFO", fmt.Sprintf("Request: <%s %s>", req.Method, req.URL.Path))
+	}
+
+	if trailer, ok := req.Context().Value(trailerKey{}).(http.Header); ok {
+		req.Trailer = trailer
+	}
+
+	if *tlsClientHeaders {
+		setTLSClientHeaders(req)
+	}
+
+	s := settingsOf(req)
+	mirror := s.sampler.ShouldMirror(req)
+
+	// clients retrying a request with the same key already had it mirrored
+	if mirror && dedup != nil {
+		if key := req.Header.Get(*dedupHeader); key != "" && dedup.Seen(key, time.Now()) {
+			atomic.AddInt64(&mirrorDuplicatesTotal, 1)
+			logMessage(id, "INFO", fmt.Sprintf("Duplicate %s <%s>, not mirroring", *dedupHeader, key))
+			mirror = false
+		}
+	}
+
+	// large uploads are skipped before anything is buffered when their length is known
+	if mirror && *maxMirrorBody > 0 && req.ContentLength > *maxMirrorBody {
+		atomic.AddInt64(&oversizedBodiesTotal, 1)
+		logMessage(id, "INFO", fmt.Sprintf("Request body of %d bytes exceeds %d bytes, not mirroring", req.ContentLength, *maxMirrorBody))
+		mirror = false
+	}
+
+	if mirror {
+		// body has to be buffered, or set up to be streamed, before production request is sent, otherwise mirrors race the proxy for reading it
+		requests, body, truncated := duplicateRequest(req, s)
+		// a body of unknown length only turns out too large while it is buffered, production still gets all of it
+		oversized := *maxMirrorBody > 0 && body.total > *maxMirrorBody
+		if oversized {
+			atomic.AddInt64(&oversizedBodiesTotal, 1)
+			logMessage(id, "INFO", fmt.Sprintf("Request body exceeds %d bytes, not mirroring", *maxMirrorBody))
+			for range requests {
+				body.release()
+			}
+			requests = nil
+		}
+		if body.hash != "" && !oversized {
+			if truncated {
+				// production gets more than the buffered part, its hash is only known once it read all of it
+				req.Body = &hashedBody{ReadCloser: req.Body, id: id, hash: sha256.New()}
+			} else {
+				logMessage(id, "INFO", fmt.Sprintf("Request body: sha256 <%s> length <%d>", body.hash, body.total))
+			}
+		}
+		if truncated && !oversized {
+			if *maxBodyPolicy == "skip" {
+				logMessage(id, "WARN", fmt.Sprintf("Request body exceeds %d bytes, not mirroring", *maxBody))
+				for range requests {
+					body.release()
+				}
+				requests = nil
+			} else {
+				logMessage(id, "WARN", fmt.Sprintf("Request body exceeds %d bytes, mirroring truncated body", *maxBody))
+			}
+		}
+		c, _ := req.Context().Value(comparisonKey{}).(*comparison)
+		// a golden response wins over the live production one as baseline
+		if g := goldenComparison(req); g != nil {
+			c = g
+		}
+		mirrored := 0
+		selected := stickyAlternative(req, s.alternatives)
+		if selected < 0 {
+			selected = weightedAlternative(s.alternatives)
+		}
+		limited := false
+		for i, req2 := range requests {
+			if limited || selected >= 0 && i != selected {
+				body.release()
+				continue
+			}
+			allowed, probe := s.alternatives[i].Breaker.Allow(time.Now())
+			if !allowed {
+				atomic.AddInt64(&mirrorCircuitOpenTotal, 1)
+				body.release()
+				continue
+			}
+			// one token per request, taken only once its first mirror is about to go out so skipped requests don't use any up
+			if mirrored == 0 {
+				if mirrorLimiter != nil && !mirrorLimiter.Allow(time.Now()) {
+					atomic.AddInt64(&mirrorRateLimitedTotal, 1)
+					logMessage(id, "WARN", "Mirror rate limit reached, not mirroring")
+					if probe {
+						s.alternatives[i].Breaker.Abort()
+					}
+					limited = true
+					body.release()
+					continue
+				}
+				recorder.record(id, req, body)
+			}
+			if probe {
+				logMessage(mirrorId(id, i), "INFO", fmt.Sprintf("Circuit breaker half open for %s, probing", s.alternatives[i].URL.Host))
+			}
+			atomic.AddInt64(&mirroredRequestsTotal, 1)
+			mirrored++
+			// clientCall takes nothing but the span and settings from the context of the client request
+			enqueueMirror(mirrorJob{id: mirrorId(id, i), target: &s.alternatives[i], req: req2.WithContext(req.Context()), body: body, c: c})
+		}
+		trace.SpanFromContext(req.Context()).SetAttributes(attribute.Int("teeproxy.mirrors", mirrored))
+	}
+
+	// ReverseProxy appends client IP to X-Forwarded-For itself after director is done, unless header is set to nil
+	if *forwardedHeaders {
+		req.Header.Set("X-Forwarded-Proto", forwardedProto(req))
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	} else {
+		req.Header["X-Forwarded-For"] = nil
+	}
+
+	req.URL = productionURL(req)
+}
+
+// where a request is sent to on production
+func productionURL(r *http.Request) *url.URL {
+	return joinURL(productionTarget(r), r.URL)
+}
+
+type productionTargetKey struct{}
+
+// production target handler picked by -target-header, the primary one when there was none
+func productionTarget(r *http.Request) url.URL {
+	if target, ok := r.Context().Value(productionTargetKey{}).(url.URL); ok {
+		return target
+	}
+	return hosts.Target
+}
+
+// target path and query are joined with the requested ones
+func joinURL(target url.URL, u *url.URL) *url.URL {
+	joined := *u
+	joined.Scheme = target.Scheme
+	joined.Host = target.Host
+	joined.Path, joined.RawPath = joinPaths(target, u)
+	joined.RawQuery = joinQuery(target.RawQuery, u.RawQuery)
+	return &joined
+}
+
+// decides whether request is sampled for the alternative destination, rand.Intn is in [0,100) so 0 never mirrors and 100 always does
+func shouldMirror(r *http.Request) bool {
+	return rand.Intn(100) < samplePercent(r)
+}
+
+// with -header-sampling an upstream can pick the percentage per request, a missing or invalid header falls back to -pct
+func samplePercent(r *http.Request) int {
+	if *headerSampling {
+		if pct, err := strconv.Atoi(strings.TrimSpace(r.Header.Get("X-Shadow-Sample"))); err == nil && pct >= 0 && pct <= 100 {
+			return pct
+		}
+	}
+	return settingsOf(r).percent
+}
+
+// exclude prefixes win over include ones, with no include prefixes every path not excluded is mirrored
+func mirrorPath(path string) bool {
+	return pathMatches(path, includePaths, excludePaths)
+}
+
+func pathMatches(path string, include, exclude []string) bool {
+	for _, prefix := range exclude {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, prefix := range include {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches Content-Type against -mirror-content-types, requests without a body have none so their Accept header is used instead
+func mirrorContentType(header http.Header) bool {
+	if len(mirrorContentTypes) == 0 {
+		return true
+	}
+
+	var types []string
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		types = []string{contentType}
+	} else {
+		types = strings.Split(header.Get("Accept"), ",")
+	}
+
+	for _, t := range types {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(t))
+		if err != nil {
+			continue
+		}
+		for _, allowed := range mirrorContentTypes {
+			allowed = strings.ToLower(allowed)
+			if mediaType == allowed || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// with -mirror-sticky-key set a request goes to a single alternative chosen by rendezvous hashing of the key,
+// so a client keeps hitting the same one and only clients of a removed alternative move elsewhere, -1 mirrors to all
+func stickyAlternative(req *http.Request, alternatives []Alternative) int {
+	if *stickyKey == "" || len(alternatives) == 0 {
+		return -1
+	}
+
+	key := ""
+	if *stickyKey == "ip" {
+		key, _, _ = net.SplitHostPort(req.RemoteAddr)
+	} else {
+		key = req.Header.Get(strings.TrimPrefix(*stickyKey, "header:"))
+	}
+
+	best, bestScore := 0, uint64(0)
+	for i, alternative := range alternatives {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(alternative.URL.String() + alternative.SocketPath))
+		if score := h.Sum64(); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// random alternative index with chances in proportion to weights, -1 when no alternative is weighted
+func weightedAlternative(alternatives []Alternative) int {
+	total := 0
+	for _, alternative := range alternatives {
+		if alternative.Weight > 0 {
+			total += alternative.Weight
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+
+	n := rand.Intn(total)
+	for i, alternative := range alternatives {
+		if alternative.Weight <= 0 {
+			continue
+		}
+		if n < alternative.Weight {
+			return i
+		}
+		n -= alternative.Weight
+	}
+	return -1
+}
+
+// each alternative destination logs under its own id, so responses from different mirrors can be told apart
+func mirrorId(id string, alternative int) string {
+	return fmt.Sprintf("%s-%d", id, alternative+1)
+}
+
+// return one copied request with empty body per alternative destination and request body, this is because each time request is sent body is read and emptied
+// we want to send same request multiple times, so returning body to use for setting up body reader on each new request
+// with -max-body set at most that many bytes are mirrored, truncated reports the body was longer, -max-mirror-body may have more of it buffered
+// every returned request holds a reference to body and has to release it once done with
+func duplicateRequest(request *http.Request, s *settings) ([]*http.Request, *requestBody, bool) {
+	body := &requestBody{}
+	truncated := false
+	contentLength := request.ContentLength
+
+	// ReverseProxy hands bodyless requests to the director with nil body
+	if request.Body != nil && streamable(request, s) {
+		body = newStreamedBody(request, *streamBuffer)
+	} else if request.Body != nil {
+		// production holds one more reference until its body is closed by the transport
+		body = newRequestBody(len(s.alternatives) + 1)
+		src := io.Reader(request.Body)
+		// whichever limit is larger, reading up to the smaller one would hide bodies over the other
+		limit := max(*maxBody, *maxMirrorBody)
+		if limit > 0 {
+			// one extra byte tells a body of exactly the limit apart from a longer one
+			src = io.LimitReader(request.Body, limit+1)
+		}
+		body.fill(src, *spillThreshold)
+		// production gets the buffered part followed by whatever is left unread past the limit
+		request.Body = &productionBody{Reader: io.MultiReader(body.section(body.total), request.Body), body: body}
+
+		if *maxBody > 0 && body.total > *maxBody {
+			truncated = true
+			body.size = *maxBody
+			contentLength = *maxBody
+		}
+		if *hashBody && body.total > 0 {
+			body.hash = bodyHash(body.Reader())
+		}
+	}
+
+	// methods like GET and HEAD carry no body, so mirrors rewritten to them drop it
+	method := request.Method
+	dropBody := false
+	if *mirrorMethod != "" {
+		method = strings.ToUpper(*mirrorMethod)
+		dropBody = method == "GET" || method == "HEAD"
+		if dropBody {
+			contentLength = 0
+		}
+	}
+
+	// the rewrite works on the decoded path, the original escaping can't be kept once it changed anything
+	requested := &url.URL{Path: request.URL.Path, RawPath: request.URL.RawPath}
+	if pathRewrite != nil {
+		if rewritten := pathRewrite.ReplaceAllString(requested.Path, pathReplacement); rewritten != requested.Path {
+			requested.Path, requested.RawPath = rewritten, ""
+		}
+	}
+
+	requests := make([]*http.Request, 0, len(s.alternatives))
+	for _, alternative := range s.alternatives {
+		u := &url.URL{
+			Scheme:   alternative.URL.Scheme,
+			Host:     alternative.URL.Host,
+			RawQuery: joinQuery(alternative.URL.RawQuery, request.URL.RawQuery),
+		}
+		u.Path, u.RawPath = joinPaths(alternative.URL, requested)
+		request2 := &http.Request{
+			Method:        method,
+			URL:           u,
+			Proto:         request.Proto,
+			ProtoMajor:    request.ProtoMajor,
+			ProtoMinor:    request.ProtoMinor,
+			Header:        make(http.Header),
+			ContentLength: contentLength,
+			Close:         false,
+		}
+
+		// Every mirror gets its own copy of the headers, as they are sent
+		// concurrently with the production request. Remove hop-by-hop
+		// headers to the backend.  Especially important is "Connection"
+		// because we want a persistent connection, regardless of what
+		// the client sent to us.
+		copyHeader(request2.Header, request.Header)
+		removeConnectionHeaders(request2.Header)
+		for _, h := range hopHeaders {
+			request2.Header.Del(h)
+		}
+		// the body is buffered or streamed by the time a mirror goes out, so there is nothing left to negotiate with the
+		// alternative, production still gets the header and the client its 100 Continue once the body is read
+		if *stripExpect {
+			request2.Header.Del("Expect")
+		}
+		// like ReverseProxy does for production, "TE: trailers" is kept as gRPC servers insist on it
+		if headerHasToken(request.Header, "Te", "trailers") {
+			request2.Header.Set("Te", "trailers")
+		}
+		for _, h := range stripHeaders {
+			request2.Header.Del(h)
+		}
+		if dropBody {
+			request2.Header.Del("Content-Type")
+			request2.Header.Del("Content-Length")
+		}
+		// trailer values are only known once the body was read to the end, which happened above unless it got truncated
+		// the transport sends trailers just with chunked bodies, so length is left unknown
+		if len(request.Trailer) > 0 && !dropBody {
+			request2.Trailer = make(http.Header)
+			copyHeader(request2.Trailer, request.Trailer)
+			request2.ContentLength = -1
+		}
+		if *forwardedHeaders {
+			setForwardedHeaders(request2.Header, request)
+		}
+		// shadow traffic can be told apart in backend logs, -mirror-ua-suffix goes after a -mirror-ua replacement
+		if *mirrorUA != "" {
+			request2.Header.Set("User-Agent", *mirrorUA)
+		}
+		if *mirrorUASuffix != "" {
+			request2.Header.Set("User-Agent", strings.TrimSpace(request2.Header.Get("User-Agent")+" "+*mirrorUASuffix))
+		}
+		for name, values := range mirrorHeaders {
+			request2.Header[name] = append([]string(nil), values...)
+		}
+		// outgoing Host header is taken from req.Host, or from URL when empty
+		if *altHost != "" {
+			request2.Host = *altHost
+		}
+
+		requests = append(requests, request2)
+	}
+
+	return requests, body, truncated
+}
+
+// a body sent to a single mirror exactly once can be streamed to it while production reads it instead of being buffered,
+// whatever reads a mirror body more than once or not right away needs the buffered copy
+func streamable(request *http.Request, s *settings) bool {
+	if *streamBuffer <= 0 || len(s.alternatives) != 1 || s.retryAttempts(&s.alternatives[0], request.Method) > 1 {
+		return false
+	}
+	if mirrorQueue != nil || *maxBody > 0 || *maxMirrorBody > 0 || *mirrorMethod != "" || len(request.Trailer) > 0 {
+		return false
+	}
+	// -mirror-only closes the production share of the body without reading it
+	return *transformCmd == "" && !*hashBody && !*mirrorGzip && !*mirrorOnly && recorder == nil && har == nil
+}
+
+// hex prefix of the SHA-256 of a body, long enough to tell bodies apart in logs without revealing them
+func bodyHash(r io.Reader) string {
+	h := sha256.New()
+	io.Copy(h, r)
+	return hashPrefix(h)
+}
+
+func hashPrefix(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// appends client IP to X-Forwarded-For left by any proxies in front of us, and records scheme and host the client asked for
+func setForwardedHeaders(header http.Header, req *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := header["X-Forwarded-For"]; len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		header.Set("X-Forwarded-For", clientIP)
+	}
+	header.Set("X-Forwarded-Proto", forwardedProto(req))
+	header.Set("X-Forwarded-Host", req.Host)
+}
+
+func forwardedProto(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// verify is SUCCESS for certificates checked against -client-ca, FAILED for ones that weren't and NONE without certificate,
+// values sent by the client itself are always dropped
+func setTLSClientHeaders(req *http.Request) {
+	req.Header.Del("X-SSL-Client-CN")
+	req.Header.Del("X-SSL-Client-Verify")
+	if req.TLS == nil {
+		return
+	}
+
+	if len(req.TLS.PeerCertificates) == 0 {
+		req.Header.Set("X-SSL-Client-Verify", "NONE")
+		return
+	}
+	req.Header.Set("X-SSL-Client-CN", req.TLS.PeerCertificates[0].Subject.CommonName)
+	if len(req.TLS.VerifiedChains) > 0 {
+		req.Header.Set("X-SSL-Client-Verify", "SUCCESS")
+	} else {
+		req.Header.Set("X-SSL-Client-Verify", "FAILED")
+	}
+}
+
+// headers listed in Connection are hop-by-hop as well (RFC 7230 section 6.1), for production ReverseProxy removes them
+// itself after teeDirector, which still needs an Upgrade header to be there
+func removeConnectionHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+}
+
+// gRPC requests have a content type of application/grpc, optionally followed by +proto or another codec
+func isGRPC(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "application/grpc")
+}
+
+// bytes the header fields take on the wire, each one as "Name: value" followed by CRLF
+func headerSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, value := range values {
+			size += len(name) + len(value) + 4
+		}
+	}
+	return size
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	code, health := http.StatusOK, healthStatus{Status: "ok"}
+	if *healthProbe {
+		if err := probeProduction(); err != nil {
+			code, health = http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Error: err.Error()}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(health)
+}
+
+// any response means production is reachable, only failing to get one is reported
+func probeProduction() error {
+	transport := proxy.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return probe(hosts.Target, transport)
+}
+
+func probe(target url.URL, transport http.RoundTripper) error {
+	req, err := http.NewRequest("HEAD", target.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type trailerKey struct{}
+
+type requestIdKey struct{}
+
+// id handler assigned to the request, requests that didn't pass through it get a new one
+func requestId(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIdKey{}).(string); ok {
+		return id
+	}
+	return ids.NewId()
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	if !clientAllowed(r.RemoteAddr) {
+		logMessage("", "WARN", fmt.Sprintf("Client not allowed: <%s %s> from <%s>", r.Method, r.URL.Path, r.RemoteAddr))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// headers copied for every mirror and dumped with -dump-requests are kept within bounds
+	if *maxHeaderBytes > 0 {
+		if size := headerSize(r.Header); size > *maxHeaderBytes {
+			atomic.AddInt64(&oversizedHeadersTotal, 1)
+			logMessage("", "WARN", fmt.Sprintf("Request headers too large: <%s %s> from <%s> with %d bytes", r.Method, r.URL.Path, r.RemoteAddr, size))
+			http.Error(w, "Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+	}
+	if !authorized(r) {
+		logMessage("", "WARN", fmt.Sprintf("Client not authorized: <%s %s> from <%s>", r.Method, r.URL.Path, r.RemoteAddr))
+		w.Header().Set("WWW-Authenticate", `Basic realm="teeproxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if *healthPath != "" && r.URL.Path == *healthPath {
+		healthHandler(w, r)
+		return
+	}
+	if *statsPath != "" && r.URL.Path == *statsPath {
+		statsHandler(w, r)
+		return
+	}
+	if *versionPath != "" && r.URL.Path == *versionPath {
+		versionHandler(w, r)
+		return
+	}
+
+	// production and mirrors get the same id in X-Request-Id as the one used for logging, one set by the client is kept
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		id = ids.NewId()
+		r.Header.Set("X-Request-Id", id)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id))
+	r = withSettings(r)
+	if len(hosts.Fallbacks) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), requestURLKey{}, r.URL))
+	}
+
+	// blue/green deployments select a named production target per request, any other value goes to the primary one
+	if *targetHeader != "" {
+		if name := r.Header.Get(*targetHeader); name != "" {
+			if target, ok := namedTargets[name]; ok {
+				r = r.WithContext(context.WithValue(r.Context(), productionTargetKey{}, target))
+			} else {
+				logMessage(id, "WARN", fmt.Sprintf("Unknown production target %s <%s>, using primary", *targetHeader, name))
+			}
+		}
+	}
+
+	// a CONNECT proxied like other requests would reach production as a request for the tunnel host, mirrored to no purpose
+	if r.Method == http.MethodConnect {
+		if !*allowConnect {
+			logMessage(id, "WARN", fmt.Sprintf("CONNECT not allowed: <%s> from <%s>", r.Host, r.RemoteAddr))
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tunnelConnect(w, r)
+		return
+	}
+
+	if isWebSocketUpgrade(r) {
+		tunnelWebSocket(w, r)
+		return
+	}
+
+	// ReverseProxy hands the director a deep copy of the request, but trailer values get filled
+	// into the original map once the body is read, so the director needs that one to forward them
+	if len(r.Trailer) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), trailerKey{}, r.Trailer))
+	}
+
+	// mirrors run on a context of their own, so only the production exchange is bounded here
+	if *prodTimeoutMs > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(*prodTimeoutMs)*time.Millisecond)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	serve := proxy.ServeHTTP
+	if *mirrorOnly {
+		serve = serveMirrorOnly
+	}
+
+	// status and size of every production response are counted, the body is only kept for -compare
+	cw := &captureResponseWriter{ResponseWriter: w}
+	if !*mirrorOnly {
+		defer func() { countProductionResponse(cw.Status(), cw.bytes) }()
+	}
+
+	// production request and mirrors get child spans of this one
+	r, span := startRequestSpan(r, id)
+	defer func() { endSpan(span, cw.Status(), nil) }()
+
+	// -compare-pct is decided apart from mirror sampling, requests not compared are proxied and mirrored as usual
+	if *compare && rand.Intn(100) < *comparePercent {
+		atomic.AddInt64(&comparisonsTotal, 1)
+		// mirrors started by teeDirector find the comparison in request context and wait for production response
+		c := newComparison()
+		cw.body.limit = *compareMaxBody
+		start := time.Now()
+		defer func() {
+			production := &capturedResponse{StatusCode: cw.Status(), Header: cw.Header(), Body: cw.body.Bytes(), Started: start, Duration: time.Since(start)}
+			if har != nil {
+				production.Request = r.Clone(context.Background())
+				production.Request.URL = productionURL(r)
+			}
+			c.setProduction(production)
+		}()
+		r = r.WithContext(context.WithValue(r.Context(), comparisonKey{}, c))
+	}
+
+	if *accessLog {
+		start := time.Now()
+		defer func() {
+			logMessage(id, "INFO", fmt.Sprintf("Access: <%s %s> status <%d> bytes <%d> duration <%v>", r.Method, r.URL.Path, cw.Status(), cw.bytes, time.Since(start)))
+		}()
+	}
+
+	serve(cw, r)
+}
+
+// timeouts are answered with 504, anything else going wrong with production with 502 as ReverseProxy does by default
+func productionError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) || r.Context().Err() == context.DeadlineExceeded {
+		status = http.StatusGatewayTimeout
+	}
+	logMessage(requestId(r), "ERROR", fmt.Sprintf("Production request failed: <%v>", err))
+	w.WriteHeader(status)
+}
+
+// with a base path only requests below it are served, with the prefix removed before forwarding and mirroring
+func newServeMux(basePath string) http.Handler {
+	mux := http.NewServeMux()
+	prefix := strings.TrimSuffix(basePath, "/")
+	if prefix == "" {
+		mux.HandleFunc("/", handler)
+	} else {
+		if !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, http.HandlerFunc(handler)))
+	}
+
+	// CONNECT requests have no path for ServeMux to match, so they go to handler directly
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			handler(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// runs the director for its mirroring only, the request it prepared for production is never sent
+func serveMirrorOnly(w http.ResponseWriter, r *http.Request) {
+	req := r.Clone(r.Context())
+	teeDirector(req)
+	if req.Body != nil {
+		// releases the production share of the buffered body
+		req.Body.Close()
+	}
+	w.WriteHeader(*mirrorOnlyStatus)
+}
+
+// want to keep text log messages on a single line, one line is one log entry
+func removeEndsOfLines(s string) string {
+	return strings.Replace(strings.Replace(s, "\n", "\\n", -1), "\r", "\\r", -1)
+}
+
+func prettyPrint(obj interface{}) string {
+	return fmt.Sprintf("%+v", obj)
+}
+
+type logEntry struct {
+	Timestamp string `json:"ts"`
+	Id        string `json:"id"`
+	Level     string `json:"level"`
+	Message   string `json:"msg"`
+}
+
+// message types ordered by severity, messages below minLogLevel are not logged
+var logLevels = map[string]int{"DEBUG": 0, "INFO": 1, "WARN": 2, "ERROR": 3}
+
+var minLogLevel int
+
+// log entries go to stdout unless -logfile is set, every entry is written in a single Write under logMu
+// so entries of concurrent mirrors never interleave
+var logOutput io.Writer = os.Stdout
+var logMu sync.Mutex
+
+func logMessage(id, messageType, message string) {
+	if logLevels[messageType] < minLogLevel {
+		return
+	}
+	ts := time.Now().Format(time.RFC3339Nano)
+	line := ""
+	if *logFormat == "json" {
+		// json escapes line endings itself, so message is written as is
+		if b, err := json.Marshal(logEntry{Timestamp: ts, Id: id, Level: messageType, Message: message}); err == nil {
+			line = string(b) + "\n"
+		}
+	}
+	if line == "" {
+		line = fmt.Sprintf("[%s][%s][%s][%s]\n", ts, id, messageType, removeEndsOfLines(message))
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	io.WriteString(logOutput, line)
+}
+
+// -logfile is appended to, or emptied first with -logfile-truncate
+func openLogFile(path string, truncate bool) (*os.File, error) {
+	mode := os.O_APPEND
+	if truncate {
+		mode = os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|mode, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open -logfile: %v", err)
+	}
+	return f, nil
+}
+
+// validates production and alternative target URLs, they need scheme and host except unix sockets which need a path
+func parseTarget(name, target string) (url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return url.URL{}, fmt.Errorf("invalid %s target %q: %v", name, target, err)
+	}
+
+	switch {
+	case u.Scheme == "unix" && name == "alternative":
+		if u.Path == "" {
+			return url.URL{}, fmt.Errorf("invalid %s target %q: missing socket path, e.g. unix:///var/run/test.sock", name, target)
+		}
+	case u.Scheme == "" || u.Host == "":
+		return url.URL{}, fmt.Errorf("invalid %s target %q: missing scheme or host, e.g. http://localhost:8080", name, target)
+	case u.Scheme != "http" && u.Scheme != "https":
+		return url.URL{}, fmt.Errorf("invalid %s target %q: scheme must be http or https", name, target)
+	}
+	return *u, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid -tls-min value %q, must be 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// parses "pattern=>replacement", replacement may refer to capture groups of pattern like $1
+func parseRewrite(rewrite string) (*regexp.Regexp, string, error) {
+	if rewrite == "" {
+		return nil, "", nil
+	}
+
+	i := strings.Index(rewrite, "=>")
+	if i < 0 {
+		return nil, "", fmt.Errorf("invalid rewrite %q, must be pattern=>replacement", rewrite)
+	}
+	pattern, err := regexp.Compile(rewrite[:i])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid rewrite pattern %q: %v", rewrite[:i], err)
+	}
+	return pattern, rewrite[i+2:], nil
+}
+
+// statusMatcher holds inclusive ranges of status codes
+type statusMatcher [][2]int
+
+func (m statusMatcher) Match(code int) bool {
+	for _, r := range m {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// parses comma separated status codes and ranges like "429,500-599"
+func parseStatusMatcher(s string) (statusMatcher, error) {
+	var m statusMatcher
+	for _, item := range splitList(s) {
+		low, high := item, item
+		if i := strings.Index(item, "-"); i >= 0 {
+			low, high = item[:i], item[i+1:]
+		}
+
+		from, err1 := strconv.Atoi(strings.TrimSpace(low))
+		to, err2 := strconv.Atoi(strings.TrimSpace(high))
+		if err1 != nil || err2 != nil || from > to {
+			return nil, fmt.Errorf("invalid status code range %q", item)
+		}
+		m = append(m, [2]int{from, to})
+	}
+	return m, nil
+}
+
+// parses "Name: Value" pairs, values given for the same name are all kept
+func parseHeaders(headers []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, h := range headers {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %q, must be \"Name: Value\"", h)
+		}
+		header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return header, nil
+}
+
+// -host-map entries are hostname=ip:port, without port the one dialed is kept
+func parseHostMap(entries []string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, e := range entries {
+		i := strings.Index(e, "=")
+		if i <= 0 || i == len(e)-1 {
+			return nil, fmt.Errorf("invalid -host-map value %q, must be hostname=ip:port", e)
+		}
+		m[strings.ToLower(strings.TrimSpace(e[:i]))] = strings.TrimSpace(e[i+1:])
+	}
+	return m, nil
+}
+
+// address dialed for addr, which TLS and the Host header don't see, so they keep using the mapped host name
+func mapHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	mapped, ok := hostMap[strings.ToLower(host)]
+	if !ok {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(mapped); err != nil {
+		return net.JoinHostPort(mapped, port)
+	}
+	return mapped
+}
+
+// splits comma separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// joins target and request path with exactly one slash between them, an empty request path keeps the target path
+// as it is and when both are empty the result is the root path
+func singleJoiningSlash(a, b string) string {
+	if b == "" {
+		if a == "" {
+			return "/"
+		}
+		return a
+	}
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// joins target and request paths like singleJoiningSlash, and also their escaped forms when either isn't escaped
+// the default way, so e.g. an encoded slash in the request path doesn't reach destinations decoded
+func joinPaths(target url.URL, u *url.URL) (path, rawPath string) {
+	path = singleJoiningSlash(target.Path, u.Path)
+	if target.RawPath == "" && u.RawPath == "" {
+		return path, ""
+	}
+	return path, singleJoiningSlash(target.EscapedPath(), u.EscapedPath())
+}
+
+// query of target comes first, separators left over at the ends of either query don't end up doubled
+func joinQuery(a, b string) string {
+	a, b = strings.TrimRight(a, "&"), strings.TrimLeft(b, "&")
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "&" + b
+}
+
+// Proxy is tee-proxy set up from its flags and optionally a config file, ready to serve requests
+// with Handler. Settings and counters are process wide, so there is a single Proxy per process
+type Proxy struct {
+	handler   http.Handler
+	tlsConfig *tls.Config
+}
+
+// NewProxy validates settings and prepares destinations. Config values apply to flags not set on the command line,
+// options left out of it get their defaults, config may be nil to only use flags
+func NewProxy(config *Config) (*Proxy, error) {
+	if err := applyConfig(config); err != nil {
+		return nil, err
+	}
+
+	if *logFormat != "text" && *logFormat != "json" {
+		return nil, fmt.Errorf("invalid -logformat value %q, must be text or json", *logFormat)
+	}
+	level, ok := logLevels[strings.ToUpper(*logLevel)]
+	if !ok {
+		return nil, fmt.Errorf("invalid -loglevel value %q, must be debug, info, warn or error", *logLevel)
+	}
+	minLogLevel = level
+	if *logFile != "" {
+		f, err := openLogFile(*logFile, *logTruncate)
+		if err != nil {
+			return nil, err
+		}
+		logOutput = f
+	}
+	if *backoff != "constant" && *backoff != "exponential" {
+		return nil, fmt.Errorf("invalid -backoff value %q, must be constant or exponential", *backoff)
+	}
+	minTLSVersion, err := parseTLSVersion(*tlsMin)
+	if err != nil {
+		return nil, err
+	}
+	if *stickyKey != "" && *stickyKey != "ip" && !strings.HasPrefix(*stickyKey, "header:") {
+		return nil, fmt.Errorf("invalid -mirror-sticky-key value %q, must be ip or header:Name", *stickyKey)
+	}
+	if *dropPolicy != "newest" && *dropPolicy != "oldest" {
+		return nil, fmt.Errorf("invalid -drop-policy value %q, must be newest or oldest", *dropPolicy)
+	}
+	if *maxBodyPolicy != "truncate" && *maxBodyPolicy != "skip" {
+		return nil, fmt.Errorf("invalid -max-body-policy value %q, must be truncate or skip", *maxBodyPolicy)
+	}
+	if *basicAuth != "" && !strings.Contains(*basicAuth, ":") {
+		return nil, errors.New("invalid -basic-auth value, must be user:pass")
+	}
+	if *harOut != "" && !*compare {
+		return nil, errors.New("-har-out needs -compare, only compared exchanges are written")
+	}
+	if *harMaxEntries < 0 {
+		return nil, fmt.Errorf("invalid -har-max-entries value %d, must be 0 or more", *harMaxEntries)
+	}
+	if *mirrorOnly && *serveAlt {
+		return nil, errors.New("-serve-alt can't be used with -mirror-only")
+	}
+	if *mirrorOnly && *compare {
+		return nil, errors.New("-compare can't be used with -mirror-only, there is no production response to compare with")
+	}
+	if *mirrorOnly && (*mirrorOnlyStatus < 100 || *mirrorOnlyStatus > 999) {
+		return nil, fmt.Errorf("invalid -mirror-only-status value %d, must be a valid status code", *mirrorOnlyStatus)
+	}
+	for _, name := range splitList(*preflightAbort) {
+		if name != "production" && name != "alternatives" {
+			return nil, fmt.Errorf("invalid -preflight-abort value %q, must be production or alternatives", name)
+		}
+	}
+	if *latencyFactor != 0 && *latencyFactor < 1 {
+		return nil, fmt.Errorf("invalid -latency-regression-factor value %v, must be at least 1", *latencyFactor)
+	}
+	if *retryJitter < 0 || *retryJitter > 1 {
+		return nil, fmt.Errorf("invalid -retry-jitter value %v, must be between 0 and 1", *retryJitter)
+	}
+	if *maxMirrorBody < 0 {
+		return nil, fmt.Errorf("invalid -max-mirror-body value %d, must be 0 or more", *maxMirrorBody)
+	}
+	if *maxHeaderBytes < 0 {
+		return nil, fmt.Errorf("invalid -max-header-bytes value %d, must be 0 or more", *maxHeaderBytes)
+	}
+	if *streamBuffer < 0 {
+		return nil, fmt.Errorf("invalid -stream-buffer value %d, must be 0 or more", *streamBuffer)
+	}
+	if *comparePercent < 0 || *comparePercent > 100 {
+		return nil, fmt.Errorf("invalid -compare-pct value %d, must be between 0 and 100", *comparePercent)
+	}
+	if *dedupSize <= 0 {
+		return nil, fmt.Errorf("invalid -dedup-size value %d, must be more than 0", *dedupSize)
+	}
+
+	// -a is the primary production target optionally followed by fallbacks
+	productions := splitList(*targetProduction)
+	if len(productions) == 0 {
+		productions = []string{""}
+	}
+	alts := splitList(*altTarget)
+	// -serve-alt swaps roles: the first alternative answers clients, production is mirrored to like the other alternatives
+	if *serveAlt {
+		if len(alts) == 0 || len(productions) > 1 {
+			return nil, errors.New("-serve-alt needs an alternative target and can't be used with fallback production targets")
+		}
+		productions[0], alts[0] = alts[0], productions[0]
+	}
+	target, err := parseTarget("production", productions[0])
+	if err != nil {
+		return nil, err
+	}
+	fallbacks := make([]url.URL, 0, len(productions)-1)
+	for _, production := range productions[1:] {
+		fallback, err := parseTarget("fallback production", production)
+		if err != nil {
+			return nil, err
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+
+	namedTargets = make(map[string]url.URL)
+	if config != nil {
+		for name, production := range config.Targets {
+			target, err := parseTarget("production", production)
+			if err != nil {
+				return nil, fmt.Errorf("production target %s: %v", name, err)
+			}
+			namedTargets[name] = target
+		}
+	}
+
+	hosts = Hosts{
+		Target:    target,
+		Fallbacks: fallbacks,
+	}
+	includePaths = splitList(*includePathsList)
+	excludePaths = splitList(*excludePathsList)
+	mirrorContentTypes = splitList(*contentTypeList)
+	ignoredHeaders = map[string]bool{}
+	for _, name := range splitList(*ignoreHeaderList) {
+		ignoredHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+
+	proxy = httputil.NewSingleHostReverseProxy(&target)
+	productionTransport := NewTimeoutTransport(time.Duration(*connectTimeoutMs)*time.Millisecond, time.Duration(*headerTimeoutMs)*time.Millisecond)
+	if *h2c || *grpcMode {
+		productionTransport.enableHTTP2()
+	}
+	proxy.Transport = productionTransport
+	if len(hosts.Fallbacks) > 0 {
+		proxy.Transport = &fallbackTransport{RoundTripper: productionTransport, fallbacks: hosts.Fallbacks}
+	}
+	if *otelEndpoint != "" {
+		if err := setupTracing(*otelEndpoint); err != nil {
+			return nil, err
+		}
+	}
+	hostMap, err = parseHostMap(hostMapList)
+	if err != nil {
+		return nil, err
+	}
+	// mirrors get their own transport, so settings for alternative destinations never affect production
+	altTransport = newMirrorTransport()
+	s, err := newSettings(config, alts, nil)
+	if err != nil {
+		return nil, err
+	}
+	currentSettings.Store(s)
+	proxy.Transport = &tracingTransport{RoundTripper: proxy.Transport}
+	proxy.Director = teeDirector
+	proxy.ErrorHandler = productionError
+
+	pathRewrite, pathReplacement, err = parseRewrite(*altRewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	retryStatuses, err = parseStatusMatcher(*retryStatusList)
+	if err != nil {
+		return nil, err
+	}
+
+	mirrorHeaders, err = parseHeaders(addHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedNets, err = parseCIDRs("allow-cidr", splitList(*allowCIDRs))
+	if err == nil {
+		deniedNets, err = parseCIDRs("deny-cidr", splitList(*denyCIDRs))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// whatever an option turns on stays off without it, also when a Proxy set up before had it
+	dedup, mirrorLimiter, mirrorQueue, assertResponse, har, golden, recorder = nil, nil, nil, nil, nil, nil, nil
+	if *dedupHeader != "" {
+		dedup = newDedupCache(*dedupSize, time.Duration(*dedupTTLMs)*time.Millisecond)
+	}
+
+	if *mirrorRps > 0 {
+		mirrorLimiter = newTokenBucket(*mirrorRps, *mirrorBurst)
+	}
+	if *workers > 0 {
+		startMirrorWorkers(*workers, *queueSize)
+	}
+
+	if *assertCmd != "" {
+		assertResponse = commandAssertion(*assertCmd)
+	}
+
+	if *harOut != "" {
+		har = &harArchive{limit: *harMaxEntries}
+	}
+
+	if *goldenFile != "" {
+		golden, err = loadGolden(*goldenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *recordFile != "" {
+		recorder, err = newRequestRecorder(*recordFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p := &Proxy{handler: newServeMux(*basePath)}
+	if *certFile != "" && *keyFile != "" {
+		p.tlsConfig = &tls.Config{MinVersion: minTLSVersion}
+		// client certificates are only asked for when something uses them, none is ever required
+		if *clientCAFile != "" {
+			pem, err := ioutil.ReadFile(*clientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			p.tlsConfig.ClientCAs = x509.NewCertPool()
+			if !p.tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in -client-ca file %s", *clientCAFile)
+			}
+			p.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		} else if *tlsClientHeaders {
+			p.tlsConfig.ClientAuth = tls.RequestClientCert
+		}
+	}
+	return p, nil
+}
+
+// Handler proxies requests to production and mirrors them to the alternatives
+func (p *Proxy) Handler() http.Handler {
+	return p.handler
+}
+
+// Close writes the -har-out file and closes the -record file, to be called once serving stopped
+func (p *Proxy) Close() error {
+	err := har.write(*harOut)
+	if closeErr := recorder.Close(); err == nil {
+		err = closeErr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if closeErr := shutdownTracing(ctx); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Main runs tee-proxy as a command, serving until SIGINT or SIGTERM and then shutting down gracefully
+func Main() {
+	// the command line has a flag set of its own, setting the same values as options, plus what only the command takes
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	options.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+	configFile := flags.String("config", "", "JSON file with settings, flags given on the command line override its values")
+	showVersion := flags.Bool("version", false, "print version, commit and Go version, then exit")
+	flags.Parse(os.Args[1:])
+	commandLineFlags = make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	if *showVersion {
+		fmt.Println(currentVersion())
+		os.Exit(0)
+	}
+
+	var config *Config
+	if *configFile != "" {
+		var err error
+		config, err = loadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	p, err := NewProxy(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	listeners, err := parseListeners(*listen, p.tlsConfig != nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *preflightCheck && !preflight(splitList(*preflightAbort)) {
+		os.Exit(1)
+	}
+
+	if *replayFile != "" {
+		count, err := replay(*replayFile)
+		if err != nil {
+			logMessage("", "ERROR", fmt.Sprintf("Replay failed: <%v>", err))
+			os.Exit(1)
+		}
+		logMessage("", "INFO", fmt.Sprintf("Replayed %d requests from <%s>", count, *replayFile))
+		os.Exit(0)
+	}
+
+	if *statsInterval > 0 {
+		go reportLatency(time.Duration(*statsInterval) * time.Millisecond)
+	}
+
+	if *metricsListen != "" {
+		go serveMetrics(*metricsListen)
+	}
+
+	servers := make([]*http.Server, 0, len(listeners))
+	for _, l := range listeners {
+		server := newServer(p, l)
+		servers = append(servers, server)
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ListenAndServeTLS(*certFile, *keyFile)
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				logMessage("", "ERROR", fmt.Sprintf("Server on %s failed: <%v>", server.Addr, err))
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// SIGHUP reloads the -config file, the proxy keeps serving with the old settings until new ones are in place
+	if *configFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reloadConfig(*configFile); err != nil {
+					logMessage("", "ERROR", fmt.Sprintf("Could not reload config, keeping current settings: <%v>", err))
+					continue
+				}
+				logMessage("", "INFO", fmt.Sprintf("Reloaded config from <%s>", *configFile))
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+
+	logMessage("", "INFO", fmt.Sprintf("Received %v, shutting down", sig))
+	shutdown(servers, time.Duration(*shutdownTimeout)*time.Millisecond)
+
+	if err := p.Close(); err != nil {
+		logMessage("", "ERROR", fmt.Sprintf("Could not close: <%v>", err))
+	}
+}
+
+// server for one -l address, all of them share the handler of p
+func newServer(p *Proxy, l listener) *http.Server {
+	server := &http.Server{Addr: l.addr, Handler: p.Handler(), MaxHeaderBytes: *maxHeaderBytes}
+	if l.tls {
+		server.TLSConfig = p.tlsConfig
+	} else if *grpcMode {
+		// gRPC clients speak HTTP/2 without TLS as well, TLS listeners negotiate it anyway
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
+}
+
+// listener is one -l address, served with HTTPS when given as https:// or, without scheme, when -cert and -key are set
+type listener struct {
+	addr string
+	tls  bool
+}
+
+func parseListeners(list string, haveCert bool) ([]listener, error) {
+	var listeners []listener
+	for _, addr := range splitList(list) {
+		l := listener{addr: addr, tls: haveCert}
+		if strings.HasPrefix(addr, "https://") {
+			l = listener{addr: strings.TrimPrefix(addr, "https://"), tls: true}
+		} else if strings.HasPrefix(addr, "http://") {
+			l = listener{addr: strings.TrimPrefix(addr, "http://")}
+		}
+		if l.tls && !haveCert {
+			return nil, fmt.Errorf("invalid -l value %q, listening with HTTPS needs -cert and -key", addr)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("invalid -l value, at least one address is needed")
+	}
+	return listeners, nil
+}
+
+// stops accepting requests on all servers and waits for in-flight requests and mirrors, giving up once timeout passes
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logMessage("", "WARN", fmt.Sprintf("Could not finish in-flight requests on %s: <%v>", server.Addr, err))
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	// no new mirrors start once server stopped handling requests
+	pending := atomic.LoadInt64(&mirrorsPending)
+	for atomic.LoadInt64(&mirrorsPending) > 0 {
+		select {
+		case <-mirrorsDrained:
+		case <-ctx.Done():
+			abandoned := atomic.LoadInt64(&mirrorsPending)
+			logMessage("", "WARN", fmt.Sprintf("Shutdown grace period passed, drained %d/%d mirrors, %d abandoned", pending-abandoned, pending, abandoned))
+			return
+		}
+	}
+	logMessage("", "INFO", fmt.Sprintf("Drained %d/%d mirrors, 0 abandoned", pending, pending))
+}
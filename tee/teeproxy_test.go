@@ -0,0 +1,2442 @@
+package tee
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Proxy set up from config, without alternatives unless config has some. Mirrors still under way are waited for
+// and options get their defaults back when the test ends, so nothing leaks into the next one
+func newProxy(t *testing.T, config *Config) *Proxy {
+	t.Helper()
+	if config.Alternatives == nil {
+		config.Alternatives = []AlternativeConfig{}
+	}
+	p, err := NewProxy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mirrors.Wait()
+		tunnels.Wait()
+		p.Close()
+		applyConfig(nil)
+	})
+	return p
+}
+
+// serves a Proxy set up from config until the test ends
+func newTestProxy(t *testing.T, config *Config) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(newProxy(t, config).Handler())
+	t.Cleanup(s.Close)
+	return s
+}
+
+// proxy like newTestProxy also reporting on the returned channel whenever its handler returned. Clients get the
+// response, or give up, before that happens, so tests wait for it before they wait for mirrors or read counters
+func newHandledTestProxy(t *testing.T, config *Config) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	handler := newProxy(t, config).Handler()
+	handled := make(chan struct{}, 100)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			handled <- struct{}{}
+		}()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s, handled
+}
+
+// waits for n handlers of a proxy made by newHandledTestProxy to return
+func waitHandled(t *testing.T, handled chan struct{}, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d requests still being handled", n-i, n)
+		}
+	}
+}
+
+// error NewProxy refuses config with, options get their defaults back when the test ends
+func proxyError(t *testing.T, config *Config) error {
+	t.Cleanup(func() {
+		applyConfig(nil)
+	})
+	_, err := NewProxy(config)
+	return err
+}
+
+// applies config to options for code tested without a Proxy, they get their defaults back when the test ends
+func setOptions(t *testing.T, config *Config) {
+	t.Helper()
+	t.Cleanup(func() {
+		applyConfig(nil)
+	})
+	if err := applyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func alternatives(urls ...string) []AlternativeConfig {
+	configs := make([]AlternativeConfig, len(urls))
+	for i, u := range urls {
+		configs[i].URL = u
+	}
+	return configs
+}
+
+func newBackend(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// backend answering 200 that passes every request it got on to the returned channel, with its body read already
+func newRecordingBackend(t *testing.T) (*httptest.Server, chan *http.Request) {
+	t.Helper()
+	received := make(chan *http.Request, 100)
+	s := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		received <- r
+	})
+	return s, received
+}
+
+func receive(t *testing.T, received chan *http.Request) *http.Request {
+	t.Helper()
+	select {
+	case r := <-received:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+		return nil
+	}
+}
+
+func bodyOf(r *http.Request) string {
+	b, _ := io.ReadAll(r.Body)
+	return string(b)
+}
+
+// logBuffer takes log entries in place of stdout until the test ends
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	logOutput = b
+	t.Cleanup(func() {
+		logOutput = os.Stdout
+	})
+	return b
+}
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+// self-signed certificate for 127.0.0.1 in PEM files, with a pool trusting it
+func writeCertificate(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "teeproxy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(certificate)
+	return certFile, keyFile, pool
+}
+
+// listener counting the connections it accepted
+type countingListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// sends a byte every interval, n of them in all
+type slowReader struct {
+	n        int
+	interval time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.interval)
+	r.n--
+	p[0] = 'x'
+	return 1, nil
+}
+
+// n bytes of a repeating pattern, the same whatever sizes they are read in, without holding them in memory
+type patternReader struct {
+	n, read int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = byte((r.read + int64(i)) % 251)
+	}
+	r.n -= int64(len(p))
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func sha256Of(r io.Reader) (string, int64) {
+	h := sha256.New()
+	n, _ := io.Copy(h, r)
+	return hex.EncodeToString(h.Sum(nil)), n
+}
+
+func TestTimeoutTransportResponseHeaderTimeout(t *testing.T) {
+	slow := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+
+	transport := NewTimeoutTransport(time.Second, 100*time.Millisecond)
+	req, _ := http.NewRequest("GET", slow.URL, nil)
+	start := time.Now()
+	_, err := transport.RoundTrip(req)
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out waiting for response from") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestTimeoutTransportSlowUpload(t *testing.T) {
+	echo := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+
+	// uploading takes 500ms, far longer than the response header timeout
+	transport := NewTimeoutTransport(100*time.Millisecond, 200*time.Millisecond)
+	req, _ := http.NewRequest("POST", echo.URL, &slowReader{n: 5, interval: 100 * time.Millisecond})
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "xxxxx" {
+		t.Errorf("body %q, want xxxxx", body)
+	}
+}
+
+func TestSlowProductionAnsweredWith504(t *testing.T) {
+	captureLog(t)
+	slow := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	s := newTestProxy(t, &Config{Production: ptr(slow.URL), HeaderTimeoutMs: ptr(100)})
+
+	if resp, _ := get(t, s.URL); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", resp.StatusCode)
+	}
+}
+
+func TestMirrorPercent(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var mirrored int64
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&mirrored, 1)
+	})
+
+	for _, tc := range []struct {
+		pct, requests int
+		min, max      int64
+	}{
+		{0, 100, 0, 0},
+		{50, 1000, 400, 600},
+		{100, 100, 100, 100},
+	} {
+		atomic.StoreInt64(&mirrored, 0)
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), Percent: ptr(tc.pct)})
+		for i := 0; i < tc.requests; i++ {
+			get(t, s.URL)
+		}
+		mirrors.Wait()
+		if n := atomic.LoadInt64(&mirrored); n < tc.min || n > tc.max {
+			t.Errorf("-pct %d mirrored %d of %d requests, want between %d and %d", tc.pct, n, tc.requests, tc.min, tc.max)
+		}
+	}
+}
+
+func TestInvalidPercent(t *testing.T) {
+	for _, pct := range []int{-1, 101} {
+		if err := proxyError(t, &Config{Percent: ptr(pct)}); err == nil {
+			t.Errorf("-pct %d accepted", pct)
+		}
+	}
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), LogFormat: ptr("json")})
+	get(t, s.URL+"/hello")
+	logMessage("id-1", "WARN", "two\nlines")
+
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	var entries []logEntry
+	for _, line := range lines {
+		var entry logEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, entry.Timestamp); err != nil {
+			t.Errorf("invalid ts in %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	request, last := entries[0], entries[len(entries)-1]
+	if request.Level != "INFO" || request.Message != "Request: <GET /hello>" || request.Id == "" {
+		t.Errorf("unexpected request entry %+v", request)
+	}
+	if last.Id != "id-1" || last.Level != "WARN" || last.Message != "two\nlines" {
+		t.Errorf("unexpected entry %+v", last)
+	}
+}
+
+func TestTextLogFormatKeepsEntriesOnOneLine(t *testing.T) {
+	log := captureLog(t)
+	logMessage("id-1", "WARN", "two\nlines")
+	if got := log.String(); !strings.HasSuffix(got, "][id-1][WARN][two\\nlines]\n") || strings.Count(got, "\n") != 1 {
+		t.Errorf("unexpected log line %q", got)
+	}
+}
+
+func TestInvalidLogFormat(t *testing.T) {
+	if err := proxyError(t, &Config{LogFormat: ptr("xml")}); err == nil {
+		t.Error("-logformat xml accepted")
+	}
+}
+
+func TestMirrorToSeveralAlternatives(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	first, fromFirst := newRecordingBackend(t)
+	second, fromSecond := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(first.URL, second.URL)})
+
+	resp, err := http.Post(s.URL+"/orders", "application/json", strings.NewReader(`{"id": 42}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for name, received := range map[string]chan *http.Request{"production": fromProduction, "first alternative": fromFirst, "second alternative": fromSecond} {
+		r := receive(t, received)
+		if r.Method != "POST" || r.URL.Path != "/orders" {
+			t.Errorf("%s got %s %s", name, r.Method, r.URL.Path)
+		}
+		if body := bodyOf(r); body != `{"id": 42}` {
+			t.Errorf("%s got body %q", name, body)
+		}
+	}
+}
+
+func TestPathFilters(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative, mirrored := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{
+		Production:   ptr(production.URL),
+		Alternatives: alternatives(alternative.URL),
+		IncludePaths: []string{"/api"},
+		ExcludePaths: []string{"/api/internal"},
+	})
+
+	for path, want := range map[string]bool{
+		"/api/internal/jobs": false,
+		"/api/orders":        true,
+		"/static/app.js":     false,
+	} {
+		if resp, _ := get(t, s.URL+path); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s answered with %d", path, resp.StatusCode)
+		}
+		mirrors.Wait()
+		if got := len(mirrored) == 1; got != want {
+			t.Errorf("%s mirrored %v, want %v", path, got, want)
+		}
+		for len(mirrored) > 0 {
+			<-mirrored
+		}
+	}
+}
+
+func TestShutdownWaitsForMirrors(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var completed int32
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		atomic.StoreInt32(&completed, 1)
+	})
+	p := newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: p.Handler()}
+	go server.Serve(listener)
+	get(t, "http://"+listener.Addr().String())
+
+	shutdown([]*http.Server{server}, 5*time.Second)
+	if atomic.LoadInt32(&completed) != 1 {
+		t.Error("shutdown returned before the mirror completed")
+	}
+	if !strings.Contains(log.String(), "Drained 1/1 mirrors, 0 abandoned") {
+		t.Errorf("no drain summary logged: %s", log)
+	}
+}
+
+func TestMaxBodyTruncatesMirrors(t *testing.T) {
+	captureLog(t)
+	const size = 32 << 20
+	want, _ := sha256Of(&patternReader{n: size})
+	production := make(chan string, 1)
+	productionBackend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		sum, _ := sha256Of(r.Body)
+		production <- sum
+	})
+	alternative, mirrored := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(productionBackend.URL), Alternatives: alternatives(alternative.URL), MaxBody: ptr(int64(1024))})
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	resp, err := http.Post(s.URL, "application/octet-stream", &patternReader{n: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	runtime.ReadMemStats(&after)
+
+	if got := <-production; got != want {
+		t.Error("production didn't get the whole body")
+	}
+	r := receive(t, mirrored)
+	if body := bodyOf(r); len(body) != 1024 || r.ContentLength != 1024 {
+		t.Errorf("mirror got %d bytes with Content-Length %d, want 1024", len(body), r.ContentLength)
+	}
+	// the body passes through to production, it is never held in memory as a whole
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/2 {
+		t.Errorf("allocated %d bytes proxying a %d byte body", allocated, size)
+	}
+}
+
+func TestMaxBodySkipPolicy(t *testing.T) {
+	log := captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, mirrored := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{
+		Production:    ptr(production.URL),
+		Alternatives:  alternatives(alternative.URL),
+		MaxBody:       ptr(int64(4)),
+		MaxBodyPolicy: ptr("skip"),
+	})
+
+	resp, err := http.Post(s.URL, "text/plain", strings.NewReader("longer than four bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mirrors.Wait()
+
+	if body := bodyOf(receive(t, fromProduction)); body != "longer than four bytes" {
+		t.Errorf("production got %q", body)
+	}
+	if len(mirrored) != 0 {
+		t.Error("body over -max-body mirrored with -max-body-policy skip")
+	}
+	if !strings.Contains(log.String(), "Request body exceeds 4 bytes, not mirroring") {
+		t.Errorf("skipped mirror not logged: %s", log)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	setOptions(t, &Config{MaxRetryWait: ptr(5000)})
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	base := 100 * time.Millisecond
+	for _, tc := range []struct {
+		retryAfter string
+		want       time.Duration
+	}{
+		{"", base},
+		{"2", 2 * time.Second},
+		{"0", 0},
+		{now.Add(3 * time.Second).Format(http.TimeFormat), 3 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"60", 5 * time.Second},
+		{now.Add(time.Hour).Format(http.TimeFormat), 5 * time.Second},
+		{"soon", base},
+	} {
+		header := http.Header{}
+		if tc.retryAfter != "" {
+			header.Set("Retry-After", tc.retryAfter)
+		}
+		if got := retryDelay(header, now, base, 0); got != tc.want {
+			t.Errorf("Retry-After %q waits %v, want %v", tc.retryAfter, got, tc.want)
+		}
+	}
+}
+
+func TestMirrorRetryHonorsRetryAfter(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var mu sync.Mutex
+	var attempts []time.Time
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	s := newTestProxy(t, &Config{
+		Production:     ptr(production.URL),
+		Alternatives:   alternatives(alternative.URL),
+		RetryCount:     ptr(2),
+		RetryTimeoutMs: ptr(1),
+		MaxRetryWait:   ptr(200),
+	})
+
+	get(t, s.URL)
+	mirrors.Wait()
+	if len(attempts) != 2 {
+		t.Fatalf("alternative got %d attempts, want 2", len(attempts))
+	}
+	// Retry-After asks for a minute, -max-retry-wait cuts it down
+	if gap := attempts[1].Sub(attempts[0]); gap < 200*time.Millisecond || gap > 2*time.Second {
+		t.Errorf("retried after %v, want about 200ms", gap)
+	}
+}
+
+func TestExponentialBackoffGapsGrow(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var mu sync.Mutex
+	var attempts []time.Time
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts = append(attempts, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	s := newTestProxy(t, &Config{
+		Production:     ptr(production.URL),
+		Alternatives:   alternatives(alternative.URL),
+		RetryCount:     ptr(4),
+		RetryTimeoutMs: ptr(20),
+		Backoff:        ptr("exponential"),
+	})
+
+	get(t, s.URL)
+	mirrors.Wait()
+	if len(attempts) != 4 {
+		t.Fatalf("alternative got %d attempts, want 4", len(attempts))
+	}
+	// waits are 20ms, 40ms and 80ms
+	for i := 2; i < len(attempts); i++ {
+		previous, gap := attempts[i-1].Sub(attempts[i-2]), attempts[i].Sub(attempts[i-1])
+		if gap < previous*3/2 {
+			t.Errorf("retry %d waited %v after a %v wait, want the gap to double", i, gap, previous)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	setOptions(t, &Config{Backoff: ptr("exponential"), BackoffMax: ptr(250)})
+	base := 100 * time.Millisecond
+	for retry, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond} {
+		if got := backoffDelay(base, retry); got != want {
+			t.Errorf("retry %d waits %v, want %v", retry, got, want)
+		}
+	}
+
+	setOptions(t, &Config{Backoff: ptr("exponential"), BackoffJitter: ptr(true)})
+	for i := 0; i < 100; i++ {
+		if got := backoffDelay(base, 1); got < base || got > 2*base {
+			t.Fatalf("jittered wait %v, want between %v and %v", got, base, 2*base)
+		}
+	}
+
+	setOptions(t, &Config{})
+	if got := backoffDelay(base, 3); got != base {
+		t.Errorf("constant backoff waits %v, want %v", got, base)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	for prior, want := range map[string]string{"": "127.0.0.1", "10.0.0.1": "10.0.0.1, 127.0.0.1"} {
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		if prior != "" {
+			req.Header.Set("X-Forwarded-For", prior)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		for name, received := range map[string]chan *http.Request{"production": fromProduction, "alternative": fromAlternative} {
+			r := receive(t, received)
+			if got := r.Header.Values("X-Forwarded-For"); len(got) != 1 || got[0] != want {
+				t.Errorf("%s got X-Forwarded-For %q, want %q", name, got, want)
+			}
+			if got := r.Header.Get("X-Forwarded-Proto"); got != "http" {
+				t.Errorf("%s got X-Forwarded-Proto %q", name, got)
+			}
+			if got := r.Header.Get("X-Forwarded-Host"); got != host {
+				t.Errorf("%s got X-Forwarded-Host %q, want %q", name, got, host)
+			}
+		}
+	}
+}
+
+func TestForwardedHeadersDisabled(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), ForwardedHeaders: ptr(false)})
+
+	get(t, s.URL)
+	for name, received := range map[string]chan *http.Request{"production": fromProduction, "alternative": fromAlternative} {
+		r := receive(t, received)
+		if r.Header.Get("X-Forwarded-Proto") != "" || r.Header.Get("X-Forwarded-Host") != "" {
+			t.Errorf("%s got forwarded headers with -forwarded-headers=false: %v", name, r.Header)
+		}
+	}
+}
+
+func TestHealthPathNeitherForwardedNorMirrored(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+
+	resp, body := get(t, s.URL+"/healthz")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" || body != `{"status":"ok"}`+"\n" {
+		t.Errorf("health check answered %d %q with %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	mirrors.Wait()
+	if len(fromProduction) != 0 || len(fromAlternative) != 0 {
+		t.Error("health check reached a backend")
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), HealthProbe: ptr(true), HealthPath: ptr("/ready")})
+	if resp, body := get(t, s.URL+"/ready"); resp.StatusCode != http.StatusOK {
+		t.Errorf("health check with production up answered %d %s", resp.StatusCode, body)
+	}
+
+	production.Close()
+	resp, body := get(t, s.URL+"/ready")
+	var health healthStatus
+	json.Unmarshal([]byte(body), &health)
+	if resp.StatusCode != http.StatusServiceUnavailable || health.Status != "unavailable" || health.Error == "" {
+		t.Errorf("health check with production down answered %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "from production")
+	})
+	certFile, keyFile, pool := writeCertificate(t)
+	p := newProxy(t, &Config{Production: ptr(production.URL), Cert: ptr(certFile), Key: ptr(keyFile), TLSMin: ptr("1.3")})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: p.Handler(), TLSConfig: p.tlsConfig}
+	go server.ServeTLS(listener, certFile, keyFile)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	url := "https://" + listener.Addr().String()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "from production" || resp.TLS == nil || resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("got %q over %+v", body, resp.TLS)
+	}
+
+	old := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS12}}}
+	if _, err := old.Get(url); err == nil {
+		t.Error("TLS 1.2 accepted with -tls-min 1.3")
+	}
+}
+
+func TestTLSClientHeaders(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	certFile, keyFile, pool := writeCertificate(t)
+	p := newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL),
+		Cert: ptr(certFile), Key: ptr(keyFile), ClientCA: ptr(certFile), TLSClientHeaders: ptr(true)})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: p.Handler(), TLSConfig: p.tlsConfig}
+	go server.ServeTLS(listener, certFile, keyFile)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	url := "https://" + listener.Addr().String()
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		certificates []tls.Certificate
+		cn, verify   string
+	}{
+		{[]tls.Certificate{certificate}, "teeproxy test", "SUCCESS"},
+		{nil, "", "NONE"},
+	} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: tc.certificates}}}
+		req, _ := http.NewRequest("GET", url, nil)
+		// set by the client itself, must not reach destinations
+		req.Header.Set("X-SSL-Client-CN", "spoofed")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for _, r := range []*http.Request{receive(t, fromProduction), receive(t, fromAlternative)} {
+			if cn, verify := r.Header.Get("X-SSL-Client-CN"), r.Header.Get("X-SSL-Client-Verify"); cn != tc.cn || verify != tc.verify {
+				t.Errorf("%s got CN %q verify %q, want %q %q", r.Host, cn, verify, tc.cn, tc.verify)
+			}
+		}
+	}
+}
+
+func TestAltInsecureOnlySkipsVerificationForAlternatives(t *testing.T) {
+	captureLog(t)
+	var mirrored int32
+	alternative := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrored, 1)
+	}))
+	t.Cleanup(alternative.Close)
+
+	for _, insecure := range []bool{false, true} {
+		atomic.StoreInt32(&mirrored, 0)
+		production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), AltInsecure: ptr(insecure), RetryCount: ptr(1)})
+		get(t, s.URL)
+		mirrors.Wait()
+		if want := map[bool]int32{false: 0, true: 1}[insecure]; atomic.LoadInt32(&mirrored) != want {
+			t.Errorf("-alt-insecure=%v got %d mirrors to a self-signed alternative, want %d", insecure, mirrored, want)
+		}
+	}
+
+	// production keeps verifying certificates
+	production := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(production.Close)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), AltInsecure: ptr(true)})
+	if resp, _ := get(t, s.URL); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("self-signed production answered %d with -alt-insecure, want 502", resp.StatusCode)
+	}
+}
+
+func TestAltHostOnlyRewritesMirrors(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), AltHost: ptr("shadow.internal")})
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Host = "shop.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if host := receive(t, fromAlternative).Host; host != "shadow.internal" {
+		t.Errorf("alternative got Host %q, want shadow.internal", host)
+	}
+	if host := receive(t, fromProduction).Host; host != "shop.example.com" {
+		t.Errorf("production got Host %q, want the one the client sent", host)
+	}
+}
+
+func TestAddHeaderOnlyOnMirrors(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{
+		Production:   ptr(production.URL),
+		Alternatives: alternatives(alternative.URL),
+		AddHeaders:   []string{"X-Shadow: true", "X-Team: checkout"},
+	})
+
+	get(t, s.URL)
+	mirrored := receive(t, fromAlternative)
+	if mirrored.Header.Get("X-Shadow") != "true" || mirrored.Header.Get("X-Team") != "checkout" {
+		t.Errorf("alternative missed injected headers: %v", mirrored.Header)
+	}
+	proxied := receive(t, fromProduction)
+	if proxied.Header.Get("X-Shadow") != "" || proxied.Header.Get("X-Team") != "" {
+		t.Errorf("injected headers leaked to production: %v", proxied.Header)
+	}
+}
+
+func TestStripHeaderOnlyOnMirrors(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{
+		Production:   ptr(production.URL),
+		Alternatives: alternatives(alternative.URL),
+		StripHeaders: []string{"Authorization", "cookie"},
+	})
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Accept", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mirrored := receive(t, fromAlternative)
+	if mirrored.Header.Get("Authorization") != "" || mirrored.Header.Get("Cookie") != "" || mirrored.Header.Get("Accept") != "text/plain" {
+		t.Errorf("alternative got headers %v", mirrored.Header)
+	}
+	proxied := receive(t, fromProduction)
+	if proxied.Header.Get("Authorization") != "Bearer secret" || proxied.Header.Get("Cookie") != "session=secret" {
+		t.Errorf("production missed stripped headers: %v", proxied.Header)
+	}
+}
+
+func TestMirrorSummary(t *testing.T) {
+	for _, tc := range []struct {
+		failures int
+		want     string
+	}{
+		{0, "[Mirror summary: status <200> retries <0> latency <"},
+		{2, "[Mirror summary: status <200> retries <2> latency <"},
+		{5, "[Mirror summary: status <503> retries <2> latency <"},
+	} {
+		log := captureLog(t)
+		production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+		var attempts int32
+		alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			if int(atomic.AddInt32(&attempts, 1)) <= tc.failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), RetryCount: ptr(3), RetryTimeoutMs: ptr(1)})
+
+		get(t, s.URL)
+		mirrors.Wait()
+		if got := log.String(); strings.Count(got, "Mirror summary") != 1 || !strings.Contains(got, tc.want) {
+			t.Errorf("%d failures logged %s, want one summary with %s", tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestDumpFlags(t *testing.T) {
+	for _, dump := range []bool{false, true} {
+		log := captureLog(t)
+		production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+		alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "alternative-secret")
+		})
+		s := newTestProxy(t, &Config{
+			Production:    ptr(production.URL),
+			Alternatives:  alternatives(alternative.URL),
+			DumpRequests:  ptr(dump),
+			DumpResponses: ptr(dump),
+		})
+
+		resp, err := http.Post(s.URL+"/orders", "text/plain", strings.NewReader("request-secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+
+		got := log.String()
+		if strings.Contains(got, "request-secret") != dump || strings.Contains(got, "alternative-secret") != dump {
+			t.Errorf("dumps %v logged %s", dump, got)
+		}
+		if !dump && (!strings.Contains(got, "[Request: <POST /orders>]") || !strings.Contains(got, "[Mirror summary: status <200>")) {
+			t.Errorf("method, path and status not logged without dumps: %s", got)
+		}
+	}
+}
+
+func TestMirrorMethodOverride(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MirrorMethod: ptr("get")})
+
+	resp, err := http.Post(s.URL+"/orders", "application/json", strings.NewReader(`{"id": 42}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mirrored := receive(t, fromAlternative)
+	if body := bodyOf(mirrored); mirrored.Method != "GET" || mirrored.ContentLength != 0 || body != "" {
+		t.Errorf("alternative got %s with Content-Length %d and body %q, want GET without body", mirrored.Method, mirrored.ContentLength, body)
+	}
+	proxied := receive(t, fromProduction)
+	if body := bodyOf(proxied); proxied.Method != "POST" || body != `{"id": 42}` {
+		t.Errorf("production got %s with body %q", proxied.Method, body)
+	}
+}
+
+func TestParseStatusMatcher(t *testing.T) {
+	m, err := parseStatusMatcher("429, 500-599")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[int]bool{200: false, 404: false, 428: false, 429: true, 430: false, 500: true, 503: true, 599: true, 600: false} {
+		if got := m.Match(code); got != want {
+			t.Errorf("%d matched %v, want %v", code, got, want)
+		}
+	}
+	for _, invalid := range []string{"abc", "500-", "599-500", "5xx"} {
+		if _, err := parseStatusMatcher(invalid); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+func TestRetryStatuses(t *testing.T) {
+	for _, tc := range []struct {
+		status   int
+		attempts int32
+	}{
+		{http.StatusTooManyRequests, 3},
+		{http.StatusNotFound, 1},
+		{http.StatusBadGateway, 3},
+	} {
+		captureLog(t)
+		production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+		var attempts int32
+		alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(tc.status)
+		})
+		s := newTestProxy(t, &Config{
+			Production:     ptr(production.URL),
+			Alternatives:   alternatives(alternative.URL),
+			RetryCount:     ptr(3),
+			RetryTimeoutMs: ptr(1),
+			RetryStatuses:  []string{"429", "500-599"},
+		})
+
+		get(t, s.URL)
+		mirrors.Wait()
+		if attempts != tc.attempts {
+			t.Errorf("status %d got %d attempts, want %d", tc.status, attempts, tc.attempts)
+		}
+	}
+}
+
+func TestMirrorConnectionsReused(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	listener := &countingListener{Listener: alternative.Listener}
+	alternative.Listener = listener
+	alternative.Start()
+	t.Cleanup(alternative.Close)
+	s := newTestProxy(t, &Config{
+		Production:             ptr(production.URL),
+		Alternatives:           alternatives(alternative.URL),
+		AltMaxIdleConns:        ptr(10),
+		AltMaxIdleConnsPerHost: ptr(5),
+		AltIdleTimeout:         ptr(60000),
+	})
+
+	for i := 0; i < 50; i++ {
+		get(t, s.URL)
+		mirrors.Wait()
+	}
+	if n := atomic.LoadInt64(&listener.accepted); n != 1 {
+		t.Errorf("50 mirrors sent one after the other opened %d connections, want 1", n)
+	}
+
+	transport := newMirrorTransport()
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 5 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("mirror transport pools %d, %d per host for %v", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+func TestTrailersMirrored(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+
+	// a body of unknown length is sent chunked, followed by the trailer
+	req, _ := http.NewRequest("POST", s.URL, io.MultiReader(strings.NewReader("chunked body")))
+	req.Trailer = http.Header{"X-Checksum": {"abc123"}}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for name, received := range map[string]chan *http.Request{"production": fromProduction, "alternative": fromAlternative} {
+		r := receive(t, received)
+		if body := bodyOf(r); body != "chunked body" || r.Trailer.Get("X-Checksum") != "abc123" {
+			t.Errorf("%s got body %q and trailer %v", name, body, r.Trailer)
+		}
+	}
+}
+
+func TestDryRunSendsNoMirrors(t *testing.T) {
+	log := captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), DryRun: ptr(true)})
+
+	resp, err := http.Post(s.URL+"/orders", "text/plain", strings.NewReader("12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mirrors.Wait()
+
+	if body := bodyOf(receive(t, fromProduction)); body != "12345" {
+		t.Errorf("production got %q", body)
+	}
+	if len(fromAlternative) != 0 {
+		t.Error("mirror sent in dry run")
+	}
+	if want := "[Dry run, would send: <POST " + alternative.URL + "/orders> headers <"; !strings.Contains(log.String(), want) || !strings.Contains(log.String(), "> body <5 bytes>]") {
+		t.Errorf("intended mirror not logged: %s", log)
+	}
+}
+
+func TestAltRewrite(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), AltRewrite: ptr("^/api/v1/(.*)$=>/shadow/v2/$1")})
+
+	for path, want := range map[string]string{
+		"/api/v1/orders/42": "/shadow/v2/orders/42",
+		"/static/app.js":    "/static/app.js",
+	} {
+		resp, _ := get(t, s.URL+path+"?q=1")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s answered %d", path, resp.StatusCode)
+		}
+		if r := receive(t, fromAlternative); r.URL.Path != want || r.URL.RawQuery != "q=1" {
+			t.Errorf("%s mirrored to %s, want %s?q=1", path, r.URL, want)
+		}
+		if r := receive(t, fromProduction); r.URL.Path != path {
+			t.Errorf("%s sent to production as %s", path, r.URL.Path)
+		}
+	}
+}
+
+func TestParseRewriteErrors(t *testing.T) {
+	for _, invalid := range []string{"/api/v1", "/api/(=>/shadow"} {
+		if _, _, err := parseRewrite(invalid); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created!")
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), AccessLog: ptr(true)})
+
+	resp, err := http.Post(s.URL+"/orders", "text/plain", strings.NewReader("order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	got := log.String()
+	i := strings.Index(got, "[Access: <POST /orders> status <201> bytes <8> duration <")
+	if i < 0 {
+		t.Fatalf("no access log line: %s", got)
+	}
+	line := got[i:]
+	line = line[strings.Index(line, "duration <")+len("duration <") : strings.Index(line, ">]")]
+	if d, err := time.ParseDuration(line); err != nil || d <= 0 {
+		t.Errorf("invalid duration %q", line)
+	}
+}
+
+func TestMirrorToUnixSocket(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	socket := filepath.Join(t.TempDir(), "alternative.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *http.Request, 1)
+	alternative := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	alternative.Listener.Close()
+	alternative.Listener = listener
+	alternative.Start()
+	t.Cleanup(alternative.Close)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives("unix://" + socket)})
+
+	get(t, s.URL+"/over/socket")
+	if r := receive(t, received); r.URL.Path != "/over/socket" {
+		t.Errorf("socket got %s", r.URL.Path)
+	}
+}
+
+// hands out req-1, req-2 and so on
+type sequentialIds struct {
+	n int32
+}
+
+func (g *sequentialIds) NewId() string {
+	return fmt.Sprintf("req-%d", atomic.AddInt32(&g.n, 1))
+}
+
+func TestInjectedIdsInLog(t *testing.T) {
+	ids = &sequentialIds{}
+	t.Cleanup(func() {
+		ids = uuidGenerator{}
+	})
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+
+	get(t, s.URL+"/first")
+	get(t, s.URL+"/second")
+	mirrors.Wait()
+	got := log.String()
+	for _, want := range []string{"][req-1][INFO][Request: <GET /first>]", "][req-2][INFO][Request: <GET /second>]", "][req-1-1][INFO][Mirror summary:", "][req-2-1][INFO][Mirror summary:"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log misses %s: %s", want, got)
+		}
+	}
+}
+
+func TestMirrorContentTypes(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MirrorContentTypes: []string{"application/json"}})
+
+	for contentType, want := range map[string]bool{
+		"image/png":                       false,
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"text/html":                       false,
+	} {
+		resp, err := http.Post(s.URL+"/upload", contentType, strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+		receive(t, fromProduction)
+		if got := len(fromAlternative) == 1; got != want {
+			t.Errorf("%s mirrored %v, want %v", contentType, got, want)
+		}
+		for len(fromAlternative) > 0 {
+			<-fromAlternative
+		}
+	}
+}
+
+func TestMirrorContentTypeFallsBackToAccept(t *testing.T) {
+	setOptions(t, &Config{MirrorContentTypes: []string{"application/*"}})
+	mirrorContentTypes = splitList(*contentTypeList)
+	t.Cleanup(func() {
+		mirrorContentTypes = nil
+	})
+	for accept, want := range map[string]bool{"text/html, application/xml;q=0.9": true, "image/*": false, "": false} {
+		if got := mirrorContentType(http.Header{"Accept": {accept}}); got != want {
+			t.Errorf("Accept %q mirrored %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name, target, err string
+	}{
+		{"production", "http://localhost:8080", ""},
+		{"alternative", "https://test.example.com/base", ""},
+		{"alternative", "unix:///var/run/test.sock", ""},
+		{"production", "localhost:8080", "missing scheme or host"},
+		{"production", "http://", "missing scheme or host"},
+		{"production", "/just/a/path", "missing scheme or host"},
+		{"production", "ftp://localhost", "scheme must be http or https"},
+		{"production", "unix:///var/run/test.sock", "missing scheme or host"},
+		{"alternative", "unix://", "missing socket path"},
+		{"production", "http://local host:80", "invalid production target"},
+	} {
+		_, err := parseTarget(tc.name, tc.target)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s %q: %v", tc.name, tc.target, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s %q: error %v, want one about %s", tc.name, tc.target, err, tc.err)
+		}
+	}
+}
+
+func TestJoinURL(t *testing.T) {
+	for _, tc := range []struct {
+		target, request, want string
+	}{
+		{"http://prod", "/a", "http://prod/a"},
+		{"http://prod", "", "http://prod/"},
+		{"http://prod/", "", "http://prod/"},
+		{"http://prod/", "/a", "http://prod/a"},
+		{"http://prod/base", "/a", "http://prod/base/a"},
+		{"http://prod/base/", "/a/", "http://prod/base/a/"},
+		{"http://prod/base", "", "http://prod/base"},
+		{"http://prod?x=1", "/a", "http://prod/a?x=1"},
+		{"http://prod/?x=1", "?y=2", "http://prod/?x=1&y=2"},
+		{"http://prod/base?x=1&", "/a?&y=2", "http://prod/base/a?x=1&y=2"},
+		{"http://prod", "/a?y=2", "http://prod/a?y=2"},
+		{"http://prod/base", "/a%2Fb", "http://prod/base/a%2Fb"},
+	} {
+		target, err := url.Parse(tc.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(tc.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := joinURL(*target, u).String(); got != tc.want {
+			t.Errorf("%q joined with %q: got %q, want %q", tc.target, tc.request, got, tc.want)
+		}
+	}
+}
+
+func TestInvalidProductionTarget(t *testing.T) {
+	if err := proxyError(t, &Config{Production: ptr("localhost:8080")}); err == nil || !strings.Contains(err.Error(), `invalid production target "localhost:8080"`) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestStickyMirrorRouting(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	type hit struct{ user, backend string }
+	hits := make(chan hit, 100)
+	var urls []string
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		urls = append(urls, newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			hits <- hit{r.Header.Get("X-User"), name}
+		}).URL)
+	}
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(urls...), MirrorStickyKey: ptr("header:X-User")})
+
+	for i := 0; i < 10; i++ {
+		for _, user := range []string{"alice", "bob"} {
+			req, _ := http.NewRequest("GET", s.URL, nil)
+			req.Header.Set("X-User", user)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+	mirrors.Wait()
+	close(hits)
+
+	backends := map[string]map[string]bool{}
+	count := 0
+	for h := range hits {
+		if backends[h.user] == nil {
+			backends[h.user] = map[string]bool{}
+		}
+		backends[h.user][h.backend] = true
+		count++
+	}
+	if count != 20 {
+		t.Errorf("%d mirrors for 20 requests, want one each", count)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if len(backends[user]) != 1 {
+			t.Errorf("%s mirrored to %v, want a single alternative", user, backends[user])
+		}
+	}
+}
+
+func TestMaxDumpBody(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("y"), 1<<20))
+	}))
+	listener := &countingListener{Listener: alternative.Listener}
+	alternative.Listener = listener
+	alternative.Start()
+	t.Cleanup(alternative.Close)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), DumpResponses: ptr(true), MaxDumpBody: ptr(100)})
+
+	for i := 0; i < 2; i++ {
+		get(t, s.URL)
+		mirrors.Wait()
+	}
+	got := log.String()
+	if want := strings.Repeat("y", 100) + "...[truncated 1048476 bytes]>]"; strings.Count(got, want) != 2 || strings.Contains(got, strings.Repeat("y", 101)) {
+		t.Error("dump not truncated at 100 bytes")
+	}
+	// the rest of the body is read all the same, so the connection is kept for the next mirror
+	if n := atomic.LoadInt64(&listener.accepted); n != 1 {
+		t.Errorf("2 mirrors opened %d connections, want 1", n)
+	}
+}
+
+func TestMirrorOnly(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MirrorOnly: ptr(true), MirrorOnlyStatus: ptr(http.StatusNoContent)})
+
+	resp, err := http.Post(s.URL+"/events", "application/json", strings.NewReader(`{"event": "signup"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("client got %d, want the canned 204", resp.StatusCode)
+	}
+
+	r := receive(t, fromAlternative)
+	if body := bodyOf(r); r.Method != "POST" || r.URL.Path != "/events" || body != `{"event": "signup"}` {
+		t.Errorf("alternative got %s %s with body %q", r.Method, r.URL.Path, body)
+	}
+	mirrors.Wait()
+	if len(fromProduction) != 0 {
+		t.Error("production got a request with -mirror-only")
+	}
+}
+
+func TestRequestIdCorrelatesLogsAndBackends(t *testing.T) {
+	for _, clientId := range []string{"", "client-chosen-id"} {
+		log := captureLog(t)
+		production, fromProduction := newRecordingBackend(t)
+		alternative, fromAlternative := newRecordingBackend(t)
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), AccessLog: ptr(true)})
+
+		req, _ := http.NewRequest("GET", s.URL+"/orders", nil)
+		if clientId != "" {
+			req.Header.Set("X-Request-Id", clientId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+
+		id := receive(t, fromProduction).Header.Get("X-Request-Id")
+		if id == "" || (clientId != "" && id != clientId) {
+			t.Errorf("production got X-Request-Id %q, client sent %q", id, clientId)
+		}
+		if mirrored := receive(t, fromAlternative).Header.Get("X-Request-Id"); mirrored != id {
+			t.Errorf("alternative got X-Request-Id %q, production %q", mirrored, id)
+		}
+		got := log.String()
+		for _, want := range []string{"][" + id + "][INFO][Request: <GET /orders>]", "][" + id + "][INFO][Access: <GET /orders>", "][" + id + "-1][INFO][Mirror summary:"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("log misses %s: %s", want, got)
+			}
+		}
+	}
+}
+
+func TestLogLevelThreshold(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	newTestProxy(t, &Config{Production: ptr(production.URL), LogLevel: ptr("warn")})
+	// logMessage is used without a proxy too, tests after this one expect INFO entries again
+	t.Cleanup(func() {
+		minLogLevel = logLevels["INFO"]
+	})
+
+	for _, level := range []string{"DEBUG", "INFO", "WARN", "ERROR"} {
+		logMessage("id", level, level+" entry")
+	}
+	got := log.String()
+	for level, want := range map[string]bool{"DEBUG": false, "INFO": false, "WARN": true, "ERROR": true} {
+		if logged := strings.Contains(got, "[id]["+level+"]["+level+" entry]"); logged != want {
+			t.Errorf("%s logged %v with -loglevel warn, want %v", level, logged, want)
+		}
+	}
+}
+
+func TestInvalidLogLevel(t *testing.T) {
+	if err := proxyError(t, &Config{LogLevel: ptr("verbose")}); err == nil {
+		t.Error("-loglevel verbose accepted")
+	}
+}
+
+func TestMirrorOutlivesClientCancel(t *testing.T) {
+	for _, tc := range []struct {
+		mirrorTimeout int
+		completed     bool
+	}{
+		{1000, true},
+		{100, false},
+	} {
+		log := captureLog(t)
+		production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		})
+		completed := make(chan bool, 1)
+		alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(300 * time.Millisecond):
+				completed <- true
+			case <-r.Context().Done():
+				completed <- false
+			}
+		})
+		s, handled := newHandledTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MirrorTimeout: ptr(tc.mirrorTimeout), RetryCount: ptr(1)})
+
+		// the client gives up long before the mirror is done, maybe even before the proxy got to mirroring
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		req, _ := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+		if _, err := http.DefaultClient.Do(req); err == nil {
+			t.Fatal("client request wasn't canceled")
+		}
+		cancel()
+		waitHandled(t, handled, 1)
+		mirrors.Wait()
+
+		if got := <-completed; got != tc.completed {
+			t.Errorf("-mirror-timeout %d completed %v, want %v", tc.mirrorTimeout, got, tc.completed)
+		}
+		if want := map[bool]string{true: "[Mirror summary: status <200>", false: "[Mirror summary: status <0>"}[tc.completed]; !strings.Contains(log.String(), want) {
+			t.Errorf("log misses %s: %s", want, log)
+		}
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	setOptions(t, &Config{RetryJitter: ptr(0.5)})
+	base := 100 * time.Millisecond
+	shortest, longest := time.Hour, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		delay := backoffDelay(base, 0)
+		if delay < 50*time.Millisecond || delay > 150*time.Millisecond {
+			t.Fatalf("wait %v outside %v ± 50%%", delay, base)
+		}
+		if delay < shortest {
+			shortest = delay
+		}
+		if delay > longest {
+			longest = delay
+		}
+	}
+	// waits spread over the range instead of all retrying in lockstep
+	if shortest > 60*time.Millisecond || longest < 140*time.Millisecond {
+		t.Errorf("waits only ranged from %v to %v", shortest, longest)
+	}
+}
+
+func TestInvalidRetryJitter(t *testing.T) {
+	for _, jitter := range []float64{-0.1, 1.5} {
+		if err := proxyError(t, &Config{RetryJitter: ptr(jitter)}); err == nil {
+			t.Errorf("-retry-jitter %v accepted", jitter)
+		}
+	}
+}
+
+func TestConnectionListedHeadersStripped(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Header.Set("Connection", "X-Custom, x-other")
+	req.Header.Set("X-Custom", "v")
+	req.Header.Set("X-Other", "w")
+	req.Header.Set("X-Kept", "k")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for name, received := range map[string]chan *http.Request{"production": fromProduction, "alternative": fromAlternative} {
+		r := receive(t, received)
+		if r.Header.Get("X-Custom") != "" || r.Header.Get("X-Other") != "" || r.Header.Get("X-Kept") != "k" {
+			t.Errorf("%s got headers %v", name, r.Header)
+		}
+	}
+}
+
+// server accepting HTTP/1.1 and h2c, reporting the protocol of every request
+func newH2CBackend(t *testing.T) (*httptest.Server, chan string) {
+	t.Helper()
+	protocols := make(chan string, 10)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocols <- r.Proto
+	}))
+	s.Config.Protocols = new(http.Protocols)
+	s.Config.Protocols.SetHTTP1(true)
+	s.Config.Protocols.SetUnencryptedHTTP2(true)
+	s.Start()
+	t.Cleanup(s.Close)
+	return s, protocols
+}
+
+func TestH2CToProduction(t *testing.T) {
+	for h2c, want := range map[bool]string{false: "HTTP/1.1", true: "HTTP/2.0"} {
+		captureLog(t)
+		production, protocols := newH2CBackend(t)
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), H2C: ptr(h2c)})
+
+		if resp, _ := get(t, s.URL); resp.StatusCode != http.StatusOK {
+			t.Errorf("-h2c=%v answered %d", h2c, resp.StatusCode)
+		}
+		if got := <-protocols; got != want {
+			t.Errorf("-h2c=%v reached production over %s, want %s", h2c, got, want)
+		}
+	}
+}
+
+func TestProdTimeout(t *testing.T) {
+	captureLog(t)
+	slow := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	alternative, mirrored := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(slow.URL), Alternatives: alternatives(alternative.URL), ProdTimeout: ptr(200)})
+
+	start := time.Now()
+	resp, _ := get(t, s.URL)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("answered after %v, want about 200ms", elapsed)
+	}
+	// the mirror isn't bounded by the production timeout
+	receive(t, mirrored)
+}
+
+func TestWeightedMirrorSelection(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var heavy, light int64
+	heavyBackend := newBackend(t, func(w http.ResponseWriter, r *http.Request) { atomic.AddInt64(&heavy, 1) })
+	lightBackend := newBackend(t, func(w http.ResponseWriter, r *http.Request) { atomic.AddInt64(&light, 1) })
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: []AlternativeConfig{
+		{URL: heavyBackend.URL, Weight: ptr(80)},
+		{URL: lightBackend.URL, Weight: ptr(20)},
+	}})
+
+	for i := 0; i < 1000; i++ {
+		get(t, s.URL)
+	}
+	mirrors.Wait()
+	// a single alternative per request, about 80/20
+	if heavy+light != 1000 || heavy < 720 || heavy > 880 {
+		t.Errorf("alternatives got %d and %d of 1000 mirrors, want about 800 and 200", heavy, light)
+	}
+}
+
+func TestShutdownReportsAbandonedMirrors(t *testing.T) {
+	log := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	release := make(chan struct{})
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fast" {
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		<-release
+	})
+	p := newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+	// lets the abandoned mirrors finish before the proxy cleanup waits for them
+	t.Cleanup(func() {
+		close(release)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: p.Handler()}
+	go server.Serve(listener)
+	for _, path := range []string{"/fast", "/slow", "/slower"} {
+		get(t, "http://"+listener.Addr().String()+path)
+	}
+
+	shutdown([]*http.Server{server}, 300*time.Millisecond)
+	if want := "[Shutdown grace period passed, drained 1/3 mirrors, 2 abandoned]"; !strings.Contains(log.String(), want) {
+		t.Errorf("log misses %s: %s", want, log)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s, handled := newHandledTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), BasePath: ptr("proxy/")})
+
+	for path, want := range map[string]string{"/proxy/users/1?x=1": "/users/1?x=1", "/proxy/": "/"} {
+		if resp, _ := get(t, s.URL+path); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s answered %d", path, resp.StatusCode)
+		}
+		waitHandled(t, handled, 1)
+		mirrors.Wait()
+		if r := receive(t, fromProduction); r.URL.String() != want {
+			t.Errorf("%s went to production as %s, want %s", path, r.URL, want)
+		}
+		if r := receive(t, fromAlternative); r.URL.String() != want {
+			t.Errorf("%s was mirrored as %s, want %s", path, r.URL, want)
+		}
+	}
+
+	for _, path := range []string{"/users/1", "/proxyusers", "/other/proxy/"} {
+		if resp, _ := get(t, s.URL+path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s outside the base path answered %d, want 404", path, resp.StatusCode)
+		}
+	}
+	waitHandled(t, handled, 3)
+	mirrors.Wait()
+	if len(fromProduction) != 0 || len(fromAlternative) != 0 {
+		t.Error("request outside the base path was forwarded")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	logs := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var attempts int32
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusGatewayTimeout)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL),
+		RetryCount: ptr(20), RetryTimeoutMs: ptr(10), RetryBudget: ptr(350)})
+
+	start := time.Now()
+	get(t, s.URL)
+	mirrors.Wait()
+	elapsed := time.Since(start)
+
+	// attempts of about 110ms each keep starting until 350ms passed, without the budget 20 would take over 2s
+	if n := atomic.LoadInt32(&attempts); n < 3 || n > 5 {
+		t.Errorf("made %d attempts, want 3 to 5 within the budget", n)
+	}
+	if elapsed > time.Second {
+		t.Errorf("mirror took %v with a retry budget of 350ms", elapsed)
+	}
+	if !strings.Contains(logs.String(), "Retry budget of 350ms exhausted after") {
+		t.Errorf("exhausted budget not logged:\n%s", logs)
+	}
+}
+
+func TestHeaderSampling(t *testing.T) {
+	newProxy(t, &Config{Percent: ptr(10), HeaderSampling: ptr(true)})
+	for header, want := range map[string]int{"25": 25, " 100 ": 100, "0": 0, "": 10, "half": 10, "101": 10, "-5": 10} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set("X-Shadow-Sample", header)
+		}
+		if got := samplePercent(r); got != want {
+			t.Errorf("X-Shadow-Sample %q sampled at %d%%, want %d%%", header, got, want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Shadow-Sample", "25")
+	mirrored := 0
+	for i := 0; i < 1000; i++ {
+		if shouldMirror(r) {
+			mirrored++
+		}
+	}
+	if mirrored < 180 || mirrored > 320 {
+		t.Errorf("mirrored %d of 1000 requests at 25%%", mirrored)
+	}
+}
+
+func TestHeaderSamplingOverridesPercent(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	alternative, fromAlternative := newRecordingBackend(t)
+	send := func(s *httptest.Server, header string) {
+		req, _ := http.NewRequest("GET", s.URL+"/"+header, nil)
+		req.Header.Set("X-Shadow-Sample", header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+	}
+
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), Percent: ptr(0), HeaderSampling: ptr(true)})
+	send(s, "100")
+	send(s, "0")
+	if r := receive(t, fromAlternative); r.URL.Path != "/100" || len(fromAlternative) != 0 {
+		t.Errorf("mirrored %s and %d more with -pct 0, want only the request sampled at 100", r.URL.Path, len(fromAlternative))
+	}
+
+	// without -header-sampling the header is ignored
+	s = newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), Percent: ptr(0)})
+	send(s, "100")
+	if len(fromAlternative) != 0 {
+		t.Error("X-Shadow-Sample honoured without -header-sampling")
+	}
+}
+
+func TestServeAlt(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "from alternative")
+	})
+	other, fromOther := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL, other.URL), ServeAlt: ptr(true)})
+
+	req, _ := http.NewRequest("POST", s.URL+"/orders", strings.NewReader("order"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "from alternative" {
+		t.Errorf("client got %d %q, want the alternative's response", resp.StatusCode, body)
+	}
+	mirrors.Wait()
+	// production and the other alternatives get copies like mirrors do
+	for name, received := range map[string]chan *http.Request{"production": fromProduction, "other alternative": fromOther} {
+		if r := receive(t, received); r.URL.Path != "/orders" || bodyOf(r) != "order" {
+			t.Errorf("%s got %s %s", name, r.Method, r.URL)
+		}
+	}
+}
+
+func TestServeAltErrors(t *testing.T) {
+	for _, config := range []*Config{
+		{ServeAlt: ptr(true), Alternatives: alternatives()},
+		{ServeAlt: ptr(true), Alternatives: alternatives("http://localhost:9001"), Production: ptr("http://localhost:9000,http://localhost:9002")},
+	} {
+		if err := proxyError(t, config); err == nil || !strings.Contains(err.Error(), "-serve-alt needs an alternative target") {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if err := proxyError(t, &Config{ServeAlt: ptr(true), MirrorOnly: ptr(true), Alternatives: alternatives("http://localhost:9001")}); err == nil || !strings.Contains(err.Error(), "can't be used with -mirror-only") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestMirrorUserAgent(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	for _, tc := range []struct {
+		ua, suffix, client, want string
+	}{
+		{"teeproxy-shadow/1.0", "", "curl/8.0", "teeproxy-shadow/1.0"},
+		{"", "teeproxy-shadow", "curl/8.0", "curl/8.0 teeproxy-shadow"},
+		{"teeproxy/1.0", "shadow", "curl/8.0", "teeproxy/1.0 shadow"},
+		{"", "teeproxy-shadow", "", "teeproxy-shadow"},
+		{"", "", "curl/8.0", "curl/8.0"},
+	} {
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MirrorUA: ptr(tc.ua), MirrorUASuffix: ptr(tc.suffix)})
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		// an empty value keeps the client from sending its default one
+		req.Header["User-Agent"] = []string{tc.client}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+		if got := receive(t, fromProduction).Header.Get("User-Agent"); got != tc.client {
+			t.Errorf("-mirror-ua %q -mirror-ua-suffix %q: production got User-Agent %q, want the client's %q", tc.ua, tc.suffix, got, tc.client)
+		}
+		if got := receive(t, fromAlternative).Header.Get("User-Agent"); got != tc.want {
+			t.Errorf("-mirror-ua %q -mirror-ua-suffix %q: mirror got User-Agent %q, want %q", tc.ua, tc.suffix, got, tc.want)
+		}
+	}
+}
+
+func TestParseListeners(t *testing.T) {
+	for _, tc := range []struct {
+		list     string
+		haveCert bool
+		want     []listener
+		err      string
+	}{
+		{":8888", false, []listener{{":8888", false}}, ""},
+		{":8888", true, []listener{{":8888", true}}, ""},
+		{"http://:80, https://:443", true, []listener{{":80", false}, {":443", true}}, ""},
+		{":80,https://:443", false, nil, "listening with HTTPS needs -cert and -key"},
+		{" , ", false, nil, "at least one address is needed"},
+	} {
+		got, err := parseListeners(tc.list, tc.haveCert)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: error %v, want one about %s", tc.list, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: got %v, %v, want %v", tc.list, got, err, tc.want)
+		}
+	}
+}
+
+func TestServingSeveralListeners(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "from production")
+	})
+	alternative, fromAlternative := newRecordingBackend(t)
+	certFile, keyFile, pool := writeCertificate(t)
+	p := newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), Cert: ptr(certFile), Key: ptr(keyFile)})
+	listeners, err := parseListeners("http://127.0.0.1:0,https://127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var servers []*http.Server
+	var urls []string
+	for _, l := range listeners {
+		server := newServer(p, l)
+		ln, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.TLSConfig != nil {
+			go server.ServeTLS(ln, certFile, keyFile)
+			urls = append(urls, "https://"+ln.Addr().String())
+		} else {
+			go server.Serve(ln)
+			urls = append(urls, "http://"+ln.Addr().String())
+		}
+		servers = append(servers, server)
+	}
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	for _, url := range urls {
+		resp, err := client.Get(url + "/" + url[:strings.Index(url, ":")])
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "from production" {
+			t.Errorf("%s answered %q", url, body)
+		}
+	}
+	mirrors.Wait()
+	if first, second := receive(t, fromAlternative).URL.Path, receive(t, fromAlternative).URL.Path; first != "/http" || second != "/https" {
+		t.Errorf("mirrored %s and %s", first, second)
+	}
+
+	// shutdown stops every one of them
+	shutdown(servers, time.Second)
+	for _, url := range urls {
+		if _, err := client.Get(url); err == nil {
+			t.Errorf("%s still serving after shutdown", url)
+		}
+	}
+}
+
+func TestRetryOnError(t *testing.T) {
+	logs := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	// nothing listens on the alternative address until its first attempt was refused
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := reserved.Addr().String()
+	reserved.Close()
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives("http://" + addr),
+		RetryOnError: ptr(true), RetryCount: ptr(10), RetryTimeoutMs: ptr(50)})
+
+	get(t, s.URL)
+	waitFor(t, "a refused attempt", func() bool { return strings.Contains(logs.String(), "Invoking client failed (connection)") })
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 10)
+	alternative := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+	})}
+	go alternative.Serve(ln)
+	t.Cleanup(func() {
+		alternative.Close()
+	})
+	mirrors.Wait()
+
+	if len(received) != 1 {
+		t.Errorf("alternative got %d requests once up, want 1", len(received))
+	}
+	if !strings.Contains(logs.String(), "connection refused>. Retrying request 2/10") {
+		t.Errorf("refused attempt not retried:\n%s", logs)
+	}
+}
+
+func TestConnectionErrorsNotRetriedByDefault(t *testing.T) {
+	logs := captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	down.Close()
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(down.URL), RetryCount: ptr(3), RetryTimeoutMs: ptr(1)})
+
+	get(t, s.URL)
+	mirrors.Wait()
+	if strings.Contains(logs.String(), "Retrying request") || !strings.Contains(logs.String(), "Invoking client failed (connection)") {
+		t.Errorf("connection error retried without -retry-on-error:\n%s", logs)
+	}
+}
+
+func TestParseHostMap(t *testing.T) {
+	m, err := parseHostMap([]string{"API.test=127.0.0.1:9001", " cache.test = 10.0.0.5 "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostMap = m
+	t.Cleanup(func() {
+		hostMap = nil
+	})
+	for addr, want := range map[string]string{
+		"api.test:80":     "127.0.0.1:9001",
+		"Cache.test:6379": "10.0.0.5:6379",
+		"other.test:80":   "other.test:80",
+		"api.test":        "api.test",
+	} {
+		if got := mapHost(addr); got != want {
+			t.Errorf("%s dialed as %s, want %s", addr, got, want)
+		}
+	}
+	for _, entry := range []string{"api.test", "=127.0.0.1:80", "api.test="} {
+		if _, err := parseHostMap([]string{entry}); err == nil {
+			t.Errorf("invalid entry %q accepted", entry)
+		}
+	}
+}
+
+func TestHostMapConnectsMirrors(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives("http://shadow.teeproxy.invalid:8080/base"),
+		HostMap: []string{"shadow.teeproxy.invalid=" + strings.TrimPrefix(alternative.URL, "http://")}})
+
+	get(t, s.URL+"/users")
+	mirrors.Wait()
+	receive(t, fromProduction)
+	// the host name that doesn't resolve is only used for the Host header
+	if r := receive(t, fromAlternative); r.Host != "shadow.teeproxy.invalid:8080" || r.URL.Path != "/base/users" {
+		t.Errorf("mirror arrived for %s%s", r.Host, r.URL.Path)
+	}
+}
+
+// writer that isn't safe for concurrent use, noting when a Write starts before the previous one returned
+type overlapDetector struct {
+	active, overlaps int32
+	writes           []string
+}
+
+func (w *overlapDetector) Write(p []byte) (int, error) {
+	if atomic.AddInt32(&w.active, 1) != 1 {
+		atomic.AddInt32(&w.overlaps, 1)
+	}
+	defer atomic.AddInt32(&w.active, -1)
+	w.writes = append(w.writes, string(p))
+	time.Sleep(10 * time.Microsecond)
+	return len(p), nil
+}
+
+func TestConcurrentLogEntriesDontInterleave(t *testing.T) {
+	w := &overlapDetector{}
+	logOutput = w
+	t.Cleanup(func() {
+		logOutput = os.Stdout
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				logMessage(fmt.Sprintf("id-%d", i), "INFO", strings.Repeat(fmt.Sprint(j%10), 4096))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if w.overlaps != 0 || len(w.writes) != 400 {
+		t.Fatalf("%d writes, %d of them overlapping, want 400 one at a time", len(w.writes), w.overlaps)
+	}
+	for _, entry := range w.writes {
+		fields := strings.Split(strings.TrimSuffix(entry, "\n"), "][")
+		if len(fields) != 4 || strings.Count(entry, "\n") != 1 || fields[3] != strings.Repeat(fields[3][:1], 4096)+"]" {
+			t.Errorf("broken entry %.80q", entry)
+		}
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "teeproxy.log")
+	if err := os.WriteFile(path, []byte("earlier entry\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		logOutput = os.Stdout
+	})
+	for _, truncate := range []bool{false, true} {
+		if f, ok := logOutput.(*os.File); ok && f != os.Stdout {
+			f.Close()
+		}
+		newProxy(t, &Config{LogFile: ptr(path), LogFileTruncate: ptr(truncate)})
+		logMessage("", "INFO", fmt.Sprintf("truncate %v", truncate))
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := strings.HasPrefix(string(b), "earlier entry\n"); kept == truncate || !strings.HasSuffix(string(b), fmt.Sprintf("[truncate %v]\n", truncate)) {
+			t.Errorf("-logfile-truncate %v left %q", truncate, b)
+		}
+	}
+	logOutput.(*os.File).Close()
+}
+
+func TestMethodRetries(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	attempts := make(chan string, 100)
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts <- r.Method
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	for _, tc := range []struct {
+		methodRetries map[string]int
+		want          map[string]int
+	}{
+		// non-idempotent methods aren't retried unless told to
+		{nil, map[string]int{"GET": 3, "PUT": 3, "DELETE": 3, "POST": 1, "PATCH": 1}},
+		{map[string]int{"POST": 2, "GET": 0}, map[string]int{"GET": 1, "PUT": 3, "POST": 2, "PATCH": 1}},
+	} {
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), RetryCount: ptr(3), RetryTimeoutMs: ptr(1), MethodRetries: tc.methodRetries})
+		for method, want := range tc.want {
+			req, _ := http.NewRequest(method, s.URL, strings.NewReader("body"))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			mirrors.Wait()
+			if got := len(attempts); got != want {
+				t.Errorf("-method-retries %v: %s made %d attempts, want %d", tc.methodRetries, method, got, want)
+			}
+			for len(attempts) > 0 {
+				<-attempts
+			}
+		}
+	}
+}
+
+func TestParseMethodRetries(t *testing.T) {
+	retries, err := parseMethodRetries("get=3, POST=0")
+	if err != nil || len(retries) != 2 || retries["GET"] != 3 || retries["POST"] != 0 {
+		t.Errorf("got %v, %v", retries, err)
+	}
+	for _, list := range []string{"GET", "=3", "GET=x", "GET=-1"} {
+		if _, err := parseMethodRetries(list); err == nil {
+			t.Errorf("invalid -method-retries %q accepted", list)
+		}
+	}
+}
+
+func TestTargetHeader(t *testing.T) {
+	logs := captureLog(t)
+	backend := func(name string) *httptest.Server {
+		return newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		})
+	}
+	primary, blue, green := backend("primary"), backend("blue"), backend("green")
+	s := newTestProxy(t, &Config{Production: ptr(primary.URL), Alternatives: alternatives(), TargetHeader: ptr("X-Target"),
+		Targets: map[string]string{"blue": blue.URL, "green": green.URL + "/v2"}})
+
+	for header, want := range map[string]string{"blue": "blue /users", "green": "green /v2/users", "": "primary /users", "purple": "primary /users"} {
+		req, _ := http.NewRequest("GET", s.URL+"/users", nil)
+		if header != "" {
+			req.Header.Set("X-Target", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("X-Target %q answered by %q, want %q", header, body, want)
+		}
+	}
+	if !strings.Contains(logs.String(), "[Unknown production target X-Target <purple>, using primary]") {
+		t.Errorf("unknown target not logged:\n%s", logs)
+	}
+}
+
+func TestInvalidNamedTarget(t *testing.T) {
+	if err := proxyError(t, &Config{Targets: map[string]string{"blue": "localhost:9000"}}); err == nil || !strings.Contains(err.Error(), "production target blue:") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestHashBody(t *testing.T) {
+	hashOf := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:16]
+	}
+	body := strings.Repeat("order 42\n", 100)
+	for _, tc := range []struct {
+		name                     string
+		maxBody                  int64
+		productionHash, mirrored string
+	}{
+		{"whole body", 0, hashOf(body), hashOf(body)},
+		// the mirror only sent the start of the body
+		{"truncated body", 100, hashOf(body), hashOf(body[:100])},
+	} {
+		logs := captureLog(t)
+		production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+		})
+		alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), HashBody: ptr(true), MaxBody: ptr(tc.maxBody)})
+
+		req, _ := http.NewRequest("POST", s.URL, strings.NewReader(body))
+		req.Header.Set("X-Request-Id", "hashed")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+
+		if want := fmt.Sprintf("[hashed][INFO][Request body: sha256 <%s> length <%d>]", tc.productionHash, len(body)); !strings.Contains(logs.String(), want) {
+			t.Errorf("%s: production hash not logged as %s:\n%s", tc.name, want, logs)
+		}
+		if want := fmt.Sprintf("body sha256 <%s>]", tc.mirrored); !strings.Contains(logs.String(), "[hashed-1][INFO][Mirror summary: ") || !strings.Contains(logs.String(), want) {
+			t.Errorf("%s: mirror hash not logged as %s:\n%s", tc.name, want, logs)
+		}
+		if strings.Contains(logs.String(), "order 42") {
+			t.Errorf("%s: body content logged", tc.name)
+		}
+	}
+}
+
+func TestRetryCountAttempts(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	var attempts int32
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	// -rc is the number of attempts, 0 sends the mirror once like 1 does
+	for rc, want := range map[int]int32{0: 1, 1: 1, 3: 3} {
+		atomic.StoreInt32(&attempts, 0)
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), RetryCount: ptr(rc), RetryTimeoutMs: ptr(1)})
+		get(t, s.URL)
+		mirrors.Wait()
+		if got := atomic.LoadInt32(&attempts); got != want {
+			t.Errorf("-rc %d made %d attempts, want %d", rc, got, want)
+		}
+	}
+
+	if err := proxyError(t, &Config{RetryCount: ptr(-1)}); err == nil || err.Error() != "invalid -rc value -1, must be 0 or more" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	logs := captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	p := newProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MaxHeaderBytes: ptr(1024)})
+	s := httptest.NewServer(p.Handler())
+	t.Cleanup(s.Close)
+	oversized := scrapeMetric(t, "teeproxy_oversized_headers_total")
+
+	send := func(url string, size int) int {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("X-Padding", strings.Repeat("x", size))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := send(s.URL, 100); status != http.StatusOK {
+		t.Errorf("small headers answered %d", status)
+	}
+	mirrors.Wait()
+	receive(t, fromProduction)
+	receive(t, fromAlternative)
+
+	// within what the server reads, the handler refuses headers above the limit
+	if status := send(s.URL, 2000); status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("2000 bytes of headers answered %d, want 431", status)
+	}
+	mirrors.Wait()
+	if len(fromProduction) != 0 || len(fromAlternative) != 0 {
+		t.Error("oversized headers forwarded")
+	}
+	if n := scrapeMetric(t, "teeproxy_oversized_headers_total") - oversized; n != 1 {
+		t.Errorf("%d oversized requests counted, want 1", n)
+	}
+	if !strings.Contains(logs.String(), "[Request headers too large: <GET /> from <127.0.0.1:") {
+		t.Errorf("oversized headers not logged:\n%s", logs)
+	}
+
+	// the listeners Main starts don't even read headers far past it
+	server := newServer(p, listener{addr: "127.0.0.1:0"})
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	if status := send("http://"+ln.Addr().String(), 64<<10); status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("64KB of headers answered %d, want 431", status)
+	}
+}
+
+func TestInvalidMaxHeaderBytes(t *testing.T) {
+	if err := proxyError(t, &Config{MaxHeaderBytes: ptr(-1)}); err == nil || !strings.Contains(err.Error(), "invalid -max-header-bytes value -1") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRawPathPreserved(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL + "/test")})
+
+	// decoding %2F would turn it into a path separator, %2f and %41 are kept just as the client wrote them
+	get(t, s.URL+"/files/a%2Fb/c%2fd%41?name=x%2Fy")
+	mirrors.Wait()
+	if r := receive(t, fromProduction); r.RequestURI != "/files/a%2Fb/c%2fd%41?name=x%2Fy" {
+		t.Errorf("production got %s", r.RequestURI)
+	}
+	if r := receive(t, fromAlternative); r.RequestURI != "/test/files/a%2Fb/c%2fd%41?name=x%2Fy" {
+		t.Errorf("alternative got %s", r.RequestURI)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	for strip, want := range map[bool]string{true: "", false: "100-continue"} {
+		captureLog(t)
+		production, fromProduction := newRecordingBackend(t)
+		alternative, fromAlternative := newRecordingBackend(t)
+		s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), StripExpect: ptr(strip)})
+
+		// the client holds the body back until the proxy answers 100 Continue, a hang fails with the timeout
+		client := &http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+		req, _ := http.NewRequest("POST", s.URL, strings.NewReader("payload"))
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+		if r := receive(t, fromProduction); r.Header.Get("Expect") != "100-continue" || bodyOf(r) != "payload" {
+			t.Errorf("-strip-expect=%v production got Expect %q", strip, r.Header.Get("Expect"))
+		}
+		if r := receive(t, fromAlternative); r.Header.Get("Expect") != want || bodyOf(r) != "payload" {
+			t.Errorf("-strip-expect=%v alternative got Expect %q", strip, r.Header.Get("Expect"))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package tee
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spans go to the global tracer provider, a no-op one unless -otel-endpoint set up an exporter
+// or a program embedding tee-proxy registered its own
+const tracerName = "github.com/damoguyan8844/teeproxy"
+
+// trace context of the client is continued, and passed on to production and every mirror in traceparent
+var tracePropagator = propagation.TraceContext{}
+
+// provider set up for -otel-endpoint, flushed on Close
+var traceProvider *sdktrace.TracerProvider
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// exports spans over OTLP/HTTP to endpoint, e.g. http://localhost:4318, batched in the background
+func setupTracing(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -otel-endpoint value %q, must be an http or https URL", endpoint)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return err
+	}
+	traceProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "teeproxy"), attribute.String("service.version", version))),
+	)
+	otel.SetTracerProvider(traceProvider)
+	return nil
+}
+
+// sends spans still waiting in the batch
+func shutdownTracing(ctx context.Context) error {
+	if traceProvider == nil {
+		return nil
+	}
+	return traceProvider.Shutdown(ctx)
+}
+
+// span of request r, left to the caller to end, continuing the trace the client sent in traceparent if any
+func startRequestSpan(r *http.Request, id string) (*http.Request, trace.Span) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, "teeproxy.request", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.path", r.URL.Path),
+		attribute.String("teeproxy.request_id", id),
+	))
+	return r.WithContext(ctx), span
+}
+
+// span of a mirror sent with req, whose headers get the traceparent of the span, a child of the
+// client request span ctx carries
+func startMirrorSpan(ctx context.Context, id string, req *http.Request) (context.Context, trace.Span) {
+	ctx, span := tracer().Start(ctx, "teeproxy.mirror", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("teeproxy.request_id", id),
+	))
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return ctx, span
+}
+
+// status of span, errors and server error responses mark it failed
+func setSpanResult(span trace.Span, status int, err error) {
+	if status > 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+func endSpan(span trace.Span, status int, err error) {
+	setSpanResult(span, status, err)
+	span.End()
+}
+
+// a span per request sent to production, a child of the one of the client request
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), "teeproxy.production", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+	))
+	// headers stay those the director prepared, the transport gets a copy carrying this span
+	req = req.WithContext(ctx)
+	req.Header = req.Header.Clone()
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	endSpan(span, status, err)
+	return resp, err
+}
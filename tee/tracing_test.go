@@ -0,0 +1,110 @@
+package tee
+
+import (
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spans end up in the returned exporter as soon as they end, until the test is over
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(t.Context())
+	})
+	return exporter
+}
+
+func spanAttribute(s tracetest.SpanStub, key string) attribute.Value {
+	for _, a := range s.Attributes {
+		if string(a.Key) == key {
+			return a.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceSpans(t *testing.T) {
+	captureLog(t)
+	exporter := recordSpans(t)
+	production, fromProduction := newRecordingBackend(t)
+	mirrored := make(chan string, 1)
+	alternative := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), RetryCount: ptr(1)})
+
+	// the client's trace is continued
+	const clientTrace, clientSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req, _ := http.NewRequest("GET", s.URL+"/users", nil)
+	req.Header.Set("X-Request-Id", "traced")
+	req.Header.Set("traceparent", "00-"+clientTrace+"-"+clientSpan+"-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mirrors.Wait()
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+	}
+	request, ok := spans["teeproxy.request"]
+	if !ok || len(spans) != 3 {
+		t.Fatalf("got spans %v, want teeproxy.request, teeproxy.production and teeproxy.mirror", spans)
+	}
+	if request.SpanKind != trace.SpanKindServer || request.Parent.SpanID().String() != clientSpan || request.SpanContext.TraceID().String() != clientTrace {
+		t.Errorf("request span %v isn't a server span under the client's %s", request.SpanContext, clientSpan)
+	}
+	if id, path := spanAttribute(request, "teeproxy.request_id").AsString(), spanAttribute(request, "url.path").AsString(); id != "traced" || path != "/users" {
+		t.Errorf("request span for %s %s", id, path)
+	}
+
+	// production and the mirror are children of the request, each with its own result
+	for name, want := range map[string]struct {
+		status int64
+		code   codes.Code
+	}{"teeproxy.production": {200, codes.Unset}, "teeproxy.mirror": {500, codes.Error}} {
+		span := spans[name]
+		if span.Parent.SpanID() != request.SpanContext.SpanID() || span.SpanKind != trace.SpanKindClient {
+			t.Errorf("%s isn't a client span under the request span", name)
+		}
+		if status := spanAttribute(span, "http.response.status_code").AsInt64(); status != want.status || span.Status.Code != want.code {
+			t.Errorf("%s ended with %d %v, want %d %v", name, status, span.Status.Code, want.status, want.code)
+		}
+		if span.EndTime.Before(span.StartTime) || span.EndTime.IsZero() {
+			t.Errorf("%s has no latency", name)
+		}
+	}
+
+	// destinations are told about their own span, not the client's
+	traceparent := func(name string) string {
+		return "00-" + clientTrace + "-" + spans[name].SpanContext.SpanID().String() + "-01"
+	}
+	if got, want := receive(t, fromProduction).Header.Get("traceparent"), traceparent("teeproxy.production"); got != want {
+		t.Errorf("production got traceparent %q, want %q", got, want)
+	}
+	if got, want := <-mirrored, traceparent("teeproxy.mirror"); got != want {
+		t.Errorf("alternative got traceparent %q, want %q", got, want)
+	}
+}
+
+func TestInvalidOtelEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"localhost:4318", "ftp://collector", "http://"} {
+		if err := setupTracing(endpoint); err == nil {
+			t.Errorf("-otel-endpoint %q accepted", endpoint)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package tee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTransformBody(t *testing.T) {
+	out, err := transformBody(context.Background(), "tr a-z A-Z", strings.NewReader("hello"))
+	if err != nil || string(out) != "HELLO" {
+		t.Errorf("got %q, %v", out, err)
+	}
+	if _, err := transformBody(context.Background(), "echo broken >&2; exit 3", strings.NewReader("hello")); err == nil || err.Error() != "exit status 3: broken" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestTransformCmdOnlyChangesMirrors(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), TransformCmd: ptr("tr a-z A-Z")})
+
+	req, _ := http.NewRequest("POST", s.URL, strings.NewReader(`{"name":"some user"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mirrors.Wait()
+	if body := bodyOf(receive(t, fromProduction)); body != `{"name":"some user"}` {
+		t.Errorf("production got %q", body)
+	}
+	r := receive(t, fromAlternative)
+	if body := bodyOf(r); body != `{"NAME":"SOME USER"}` || r.ContentLength != int64(len(body)) {
+		t.Errorf("alternative got %q with Content-Length %d", body, r.ContentLength)
+	}
+}
+
+func TestFailingTransformCmdSkipsMirror(t *testing.T) {
+	logs := captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), TransformCmd: ptr("echo bad payload >&2; exit 1")})
+
+	req, _ := http.NewRequest("POST", s.URL, strings.NewReader("payload"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mirrors.Wait()
+	if resp.StatusCode != http.StatusOK || bodyOf(receive(t, fromProduction)) != "payload" {
+		t.Errorf("production answered %d", resp.StatusCode)
+	}
+	if len(fromAlternative) != 0 {
+		t.Error("mirror sent although its body couldn't be transformed")
+	}
+	if !strings.Contains(logs.String(), "[Could not transform body, not mirroring: <exit status 1: bad payload>]") {
+		t.Errorf("failure not logged:\n%s", logs)
+	}
+}
+
+func TestMirrorGzip(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL), MirrorGzip: ptr(true)})
+	body := strings.Repeat(`{"name":"some user"}`, 100)
+
+	send := func(body, encoding string) {
+		req, _ := http.NewRequest("POST", s.URL, strings.NewReader(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		mirrors.Wait()
+	}
+	send(body, "")
+	if r := receive(t, fromProduction); r.Header.Get("Content-Encoding") != "" || bodyOf(r) != body {
+		t.Error("production got the body compressed")
+	}
+	r := receive(t, fromAlternative)
+	compressed, _ := io.ReadAll(r.Body)
+	if r.Header.Get("Content-Encoding") != "gzip" || r.ContentLength != int64(len(compressed)) || len(compressed) >= len(body) {
+		t.Fatalf("alternative got %d bytes with Content-Length %d and Content-Encoding %q", len(compressed), r.ContentLength, r.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed, err := io.ReadAll(zr); err != nil || string(decompressed) != body {
+		t.Errorf("alternative body decompressed to %d bytes, %v", len(decompressed), err)
+	}
+
+	// a body the client encoded already is mirrored as it is
+	send("already encoded", "br")
+	receive(t, fromProduction)
+	if r := receive(t, fromAlternative); r.Header.Get("Content-Encoding") != "br" || bodyOf(r) != "already encoded" {
+		t.Errorf("encoded body changed, Content-Encoding %q", r.Header.Get("Content-Encoding"))
+	}
+}
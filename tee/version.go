@@ -0,0 +1,35 @@
+package tee
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// filled in at build time, e.g.
+// go build -ldflags "-X github.com/damoguyan8844/teeproxy/tee.version=1.2.0 -X github.com/damoguyan8844/teeproxy/tee.commit=$(git rev-parse --short HEAD)"
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentVersion() versionInfo {
+	return versionInfo{Version: version, Commit: commit, GoVersion: runtime.Version()}
+}
+
+func (v versionInfo) String() string {
+	return fmt.Sprintf("teeproxy %s (commit %s, %s)", v.Version, v.Commit, v.GoVersion)
+}
+
+// answers -version-path with what -version prints, as JSON
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentVersion())
+}
@@ -0,0 +1,55 @@
+package tee
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+// values -ldflags -X would set
+func injectVersion(t *testing.T, v, c string) {
+	previousVersion, previousCommit := version, commit
+	version, commit = v, c
+	t.Cleanup(func() {
+		version, commit = previousVersion, previousCommit
+	})
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	captureLog(t)
+	injectVersion(t, "1.2.3", "abc1234")
+	production, fromProduction := newRecordingBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(alternative.URL)})
+
+	resp, body := get(t, s.URL+"/version")
+	var got versionInfo
+	if err := json.Unmarshal([]byte(body), &got); err != nil || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("version answered %q as %s: %v", body, resp.Header.Get("Content-Type"), err)
+	}
+	if want := (versionInfo{Version: "1.2.3", Commit: "abc1234", GoVersion: runtime.Version()}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	mirrors.Wait()
+	if len(fromProduction) != 0 || len(fromAlternative) != 0 {
+		t.Error("version request forwarded")
+	}
+
+	if got, want := currentVersion().String(), "teeproxy 1.2.3 (commit abc1234, "+runtime.Version()+")"; got != want {
+		t.Errorf("-version printed %q, want %q", got, want)
+	}
+}
+
+func TestVersionPathDisabled(t *testing.T) {
+	captureLog(t)
+	production, fromProduction := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives(), VersionPath: ptr("")})
+
+	if resp, _ := get(t, s.URL+"/version"); resp.StatusCode != http.StatusOK {
+		t.Errorf("answered %d", resp.StatusCode)
+	}
+	if r := receive(t, fromProduction); r.URL.Path != "/version" {
+		t.Errorf("production got %s", r.URL.Path)
+	}
+}
@@ -0,0 +1,115 @@
+package tee
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// true for requests asking to switch the connection to the WebSocket protocol
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// header values are comma separated token lists, compared case insensitively
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tracks WebSocket and CONNECT tunnels until both of their connections are closed, server shutdown doesn't wait for
+// hijacked connections so this is what tests wait on before options are reset
+var tunnels sync.WaitGroup
+
+// forwards the upgrade request to production and then copies bytes both ways on the hijacked client connection,
+// WebSocket traffic is never mirrored as the alternative can't take part in the same conversation
+func tunnelWebSocket(w http.ResponseWriter, r *http.Request) {
+	tunnels.Add(1)
+	defer tunnels.Done()
+	id := requestId(r)
+	atomic.AddInt64(&requestsTotal, 1)
+	logMessage(id, "INFO", fmt.Sprintf("WebSocket upgrade: <%s %s>", r.Method, r.URL.Path))
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logMessage(id, "ERROR", "WebSocket upgrade not supported by connection")
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	backend, err := dialProduction(productionTarget(r))
+	if err != nil {
+		logMessage(id, "ERROR", fmt.Sprintf("Could not connect to production for WebSocket: <%v>", err))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+
+	outreq := r.Clone(r.Context())
+	outreq.URL = productionURL(r)
+	if err := outreq.Write(backend); err != nil {
+		logMessage(id, "ERROR", fmt.Sprintf("Could not send WebSocket upgrade to production: <%v>", err))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		logMessage(id, "ERROR", fmt.Sprintf("Could not hijack connection for WebSocket: <%v>", err))
+		return
+	}
+	defer client.Close()
+
+	// whatever the client sent after the upgrade request may already sit in the read buffer
+	copyBothWays(client, buffered, backend)
+	logMessage(id, "INFO", "WebSocket closed")
+}
+
+// copies bytes between client and backend until either side is done, reading the client through buffered
+func copyBothWays(client net.Conn, buffered io.Reader, backend net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+
+	// once either side is done both connections get closed by the caller, ending the other copy too
+	<-done
+}
+
+func dialProduction(target url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(*connectTimeoutMs) * time.Millisecond}
+
+	if target.Scheme == "https" {
+		return tls.DialWithDialer(dialer, "tcp", productionAddr(target), &tls.Config{ServerName: target.Hostname()})
+	}
+	return dialer.Dial("tcp", productionAddr(target))
+}
+
+// host and port of a production target, with the default port of its scheme when it has none
+func productionAddr(target url.URL) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+	if target.Scheme == "https" {
+		return net.JoinHostPort(target.Hostname(), "443")
+	}
+	return net.JoinHostPort(target.Hostname(), "80")
+}
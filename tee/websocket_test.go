@@ -0,0 +1,121 @@
+package tee
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// small unfragmented text frames are all the tests need, clients mask theirs
+func writeFrame(w io.Writer, payload string, mask bool) error {
+	frame := []byte{0x81, byte(len(payload))}
+	data := []byte(payload)
+	if mask {
+		key := []byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, key...)
+		for i := range data {
+			data[i] ^= key[i%4]
+		}
+	}
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func readFrame(r io.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	var key []byte
+	if header[1]&0x80 != 0 {
+		key = make([]byte, 4)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return "", err
+		}
+	}
+	data := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	for i := range key {
+		for j := i; j < len(data); j += 4 {
+			data[j] ^= key[i]
+		}
+	}
+	return string(data), nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// WebSocket server echoing every frame it gets
+func newEchoWebSocketBackend(t *testing.T) string {
+	return newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			http.Error(w, "not a WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "+acceptKey(r.Header.Get("Sec-WebSocket-Key"))+"\r\n\r\n")
+		for {
+			message, err := readFrame(buffered)
+			if err != nil {
+				return
+			}
+			writeFrame(conn, message, false)
+		}
+	}).URL
+}
+
+func TestWebSocketEchoThroughProxy(t *testing.T) {
+	captureLog(t)
+	production := newEchoWebSocketBackend(t)
+	alternative, fromAlternative := newRecordingBackend(t)
+	s := newTestProxy(t, &Config{Production: ptr(production), Alternatives: alternatives(alternative.URL)})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: "+key+"\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		t.Fatalf("upgrade answered %d with %v", resp.StatusCode, resp.Header)
+	}
+
+	for _, message := range []string{"hello", "through the tunnel"} {
+		if err := writeFrame(conn, message, true); err != nil {
+			t.Fatal(err)
+		}
+		if echo, err := readFrame(reader); err != nil || echo != message {
+			t.Errorf("echo %q, %v, want %q", echo, err, message)
+		}
+	}
+
+	conn.Close()
+	mirrors.Wait()
+	if len(fromAlternative) != 0 {
+		t.Error("WebSocket upgrade mirrored")
+	}
+}
@@ -0,0 +1,61 @@
+package tee
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// captureResponseWriter records status and size of the response written through it,
+// along with the start of the body up to body limit
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	body   cappedBuffer
+}
+
+func (w *captureResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// status sent to the client, which is 200 when nothing was written at all
+func (w *captureResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// ReverseProxy flushes streamed responses, so the wrapped writer has to keep supporting it
+func (w *captureResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ReverseProxy hijacks the client connection to switch protocols on a 101 response
+func (w *captureResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// lets http.ResponseController reach the client connection for anything not implemented here
+func (w *captureResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
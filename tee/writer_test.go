@@ -0,0 +1,108 @@
+package tee
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &captureResponseWriter{ResponseWriter: rec, body: cappedBuffer{limit: 4}}
+	w.WriteHeader(http.StatusCreated)
+	// only the first status reaches the client
+	w.WriteHeader(http.StatusInternalServerError)
+	io.WriteString(w, "hello ")
+	io.WriteString(w, "world")
+	w.Flush()
+
+	if w.Status() != http.StatusCreated || w.bytes != 11 || w.body.String() != "hell" {
+		t.Errorf("captured %d, %d bytes, body %q", w.Status(), w.bytes, w.body.String())
+	}
+	if rec.Code != http.StatusCreated || rec.Body.String() != "hello world" || !rec.Flushed {
+		t.Errorf("client got %d %q, flushed %v", rec.Code, rec.Body, rec.Flushed)
+	}
+	// ResponseRecorder can't be hijacked, neither can its wrapper
+	if _, _, err := w.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("hijack failed with %v", err)
+	}
+	if http.NewResponseController(w).Flush() != nil {
+		t.Error("flush through ResponseController failed")
+	}
+
+	// nothing written at all is an empty 200
+	if w := (&captureResponseWriter{ResponseWriter: httptest.NewRecorder()}); w.Status() != http.StatusOK || w.bytes != 0 {
+		t.Errorf("empty response captured as %d with %d bytes", w.Status(), w.bytes)
+	}
+}
+
+func TestProductionResponseSizesCounted(t *testing.T) {
+	captureLog(t)
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, strings.Repeat("x", 1000))
+	})
+	s, handled := newHandledTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives()})
+	bytes, accepted := scrapeMetric(t, "teeproxy_production_response_bytes_total"), scrapeMetric(t, `teeproxy_production_responses_total{code="2xx"}`)
+
+	for i := 0; i < 3; i++ {
+		get(t, s.URL)
+	}
+	// responses are counted once the handler is done with them, after the client got them
+	waitHandled(t, handled, 3)
+	if got := scrapeMetric(t, "teeproxy_production_response_bytes_total") - bytes; got != 3000 {
+		t.Errorf("counted %d response bytes, want 3000", got)
+	}
+	if got := scrapeMetric(t, `teeproxy_production_responses_total{code="2xx"}`) - accepted; got != 3 {
+		t.Errorf("counted %d 2xx responses, want 3", got)
+	}
+}
+
+func TestStreamedProductionResponseFlushed(t *testing.T) {
+	captureLog(t)
+	next := make(chan struct{})
+	production := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		for _, line := range []string{"first\n", "second\n"} {
+			io.WriteString(w, line)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	})
+	s := newTestProxy(t, &Config{Production: ptr(production.URL), Alternatives: alternatives()})
+
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	// each line arrives while production still holds the rest of the response back
+	for _, want := range []string{"first\n", "second\n"} {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Errorf("got %q, want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not flushed to the client", want)
+		}
+		next <- struct{}{}
+	}
+}